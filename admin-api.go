@@ -0,0 +1,53 @@
+package main
+
+import (
+  "crypto/subtle"
+  "encoding/json"
+  "net/http"
+  "os"
+  "strings"
+)
+
+// The admin API shares the metrics port. Every endpoint needs
+// "Authorization: Bearer $ADMIN_API_TOKEN" and the API is off entirely when
+// no token is configured.
+var adminAPIToken string
+
+func init() {
+  adminAPIToken = os.Getenv("ADMIN_API_TOKEN")
+}
+
+func registerAdminAPI(mux *http.ServeMux) {
+  mux.Handle("/usage", adminOnly(usageHandler))
+  mux.Handle("/usage/sessions", adminOnly(usageSessionsHandler))
+  mux.Handle("/sessions", adminOnly(sessionsHandler))
+  mux.Handle("/sessions/", adminOnly(sessionHandler))
+}
+
+func adminOnly(handler http.HandlerFunc) (http.Handler) {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if adminAPIToken == "" {
+      http.NotFound(w, r)
+      return
+    }
+
+    token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    if subtle.ConstantTimeCompare([]byte(token), []byte(adminAPIToken)) != 1 {
+      w.Header().Set("WWW-Authenticate", "Bearer")
+      writeAPIError(w, http.StatusUnauthorized, "unauthorized")
+      return
+    }
+
+    handler(w, r)
+  })
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  json.NewEncoder(w).Encode(body)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+  writeJSON(w, status, map[string]string{"error": message})
+}
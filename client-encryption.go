@@ -0,0 +1,434 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "crypto/cipher"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/binary"
+  "encoding/hex"
+  "errors"
+  "io"
+  "io/ioutil"
+  "os"
+  "strings"
+  "sync"
+
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/kms"
+  "github.com/aws/aws-sdk-go/service/s3"
+)
+
+// With client-side encryption every object gets its own data key. Its
+// contents are split into envelopeChunkSize chunks sealed with AES-256-GCM
+// under that key, so any chunk can be decrypted on its own and ranged reads
+// keep working. The data key is wrapped with the server's master key and kept
+// in the object's metadata, S3 only ever sees ciphertext.
+const (
+  envelopeChunkSize = 64 * kb
+  envelopeTagSize = 16
+  envelopeVersion = "1"
+
+  envelopeVersionHeader = "S3tp-Envelope"
+  wrappedKeyHeader = "S3tp-Wrapped-Key"
+  masterKeyHeader = "S3tp-Master-Key"
+)
+
+// HEADs in flight at once for one listing, see envelope_sizes
+const envelopeHeadConcurrency = 16
+
+var (
+  errNoMasterKey = errors.New("client-side encryption needs CLIENT_ENCRYPTION_KEYFILE or CLIENT_ENCRYPTION_KMS_KEY_ID")
+  errWrongMasterKey = errors.New("object was encrypted with a different master key")
+)
+
+var clientSideEncryption int
+
+func init() {
+  setFromENV("CLIENT_SIDE_ENCRYPTION", &clientSideEncryption, 0)
+}
+
+// Wraps data keys, nil unless a keyfile or KMS key is configured
+var masterKey keyWrapper
+
+type keyWrapper interface {
+  // recorded with each object so we can tell when the master key changed
+  id() (string)
+  wrap(ctx context.Context, key []byte) (string, error)
+  unwrap(ctx context.Context, wrapped string) ([]byte, error)
+}
+
+func loadMasterKey() (error) {
+  keyfile := os.Getenv("CLIENT_ENCRYPTION_KEYFILE")
+  kmsKeyID := os.Getenv("CLIENT_ENCRYPTION_KMS_KEY_ID")
+
+  switch {
+  case keyfile != "" && kmsKeyID != "":
+    return errors.New("set one of CLIENT_ENCRYPTION_KEYFILE and CLIENT_ENCRYPTION_KMS_KEY_ID")
+  case keyfile != "":
+    contents, err := ioutil.ReadFile(keyfile)
+    if err != nil {
+      return err
+    }
+
+    key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents)))
+    if err != nil || len(key) != 32 {
+      return errors.New("CLIENT_ENCRYPTION_KEYFILE must hold 32 bytes, base64 encoded")
+    }
+
+    masterKey = newKeyfileMasterKey(key)
+  case kmsKeyID != "":
+    region := os.Getenv("CLIENT_ENCRYPTION_KMS_REGION")
+    if region == "" {
+      region = "us-east-1"
+    }
+
+    config := &aws.Config{Region: aws.String(region)}
+    if endpoint := os.Getenv("CLIENT_ENCRYPTION_KMS_ENDPOINT"); endpoint != "" {
+      config.Endpoint = aws.String(endpoint)
+    }
+
+    sess, err := session.NewSession(config)
+    if err != nil {
+      return err
+    }
+
+    masterKey = &kmsMasterKey{client: kms.New(sess), keyID: kmsKeyID}
+  }
+
+  return nil
+}
+
+// A key read from a local file, data keys are sealed with it like SSE-C keys
+type keyfileMasterKey struct {
+  key []byte
+  keyID string
+}
+
+func newKeyfileMasterKey(key []byte) (*keyfileMasterKey) {
+  sum := sha256.Sum256(key)
+
+  return &keyfileMasterKey{key: key, keyID: "keyfile:" + hex.EncodeToString(sum[:8])}
+}
+
+func (k *keyfileMasterKey) id() (string) {
+  return k.keyID
+}
+
+func (k *keyfileMasterKey) wrap(ctx context.Context, key []byte) (string, error) {
+  return sealKey(k.key, key)
+}
+
+func (k *keyfileMasterKey) unwrap(ctx context.Context, wrapped string) ([]byte, error) {
+  return openSealedKey(k.key, wrapped)
+}
+
+// A key held by KMS or anything that speaks its Encrypt and Decrypt API. It's
+// used with the server's own credentials, users don't need access to it.
+type kmsMasterKey struct {
+  client *kms.KMS
+  keyID string
+}
+
+func (k *kmsMasterKey) id() (string) {
+  return "kms:" + k.keyID
+}
+
+func (k *kmsMasterKey) wrap(ctx context.Context, key []byte) (string, error) {
+  output, err := k.client.EncryptWithContext(ctx, &kms.EncryptInput{
+    KeyId: aws.String(k.keyID),
+    Plaintext: key,
+  })
+  if err != nil {
+    return "", err
+  }
+
+  return base64.StdEncoding.EncodeToString(output.CiphertextBlob), nil
+}
+
+func (k *kmsMasterKey) unwrap(ctx context.Context, wrapped string) ([]byte, error) {
+  blob, err := base64.StdEncoding.DecodeString(wrapped)
+  if err != nil {
+    return nil, err
+  }
+
+  output, err := k.client.DecryptWithContext(ctx, &kms.DecryptInput{CiphertextBlob: blob})
+  if err != nil {
+    return nil, err
+  }
+
+  return output.Plaintext, nil
+}
+
+func (e *encryptionSettings) client_side() (bool) {
+  return e != nil && e.clientSide
+}
+
+type envelope struct {
+  aead cipher.AEAD
+}
+
+func newEnvelope(key []byte) (*envelope, error) {
+  aead, err := newGCM(key)
+  if err != nil {
+    return nil, err
+  }
+
+  return &envelope{aead: aead}, nil
+}
+
+// Chunks are numbered from 0 and the last one is marked so that dropping or
+// reordering chunks, or cutting an object short, fails to decrypt.
+func (e *envelope) nonce(index int64, last bool) ([]byte) {
+  nonce := make([]byte, e.aead.NonceSize())
+  binary.BigEndian.PutUint64(nonce[:8], uint64(index))
+  if last {
+    nonce[len(nonce) - 1] = 1
+  }
+
+  return nonce
+}
+
+func (e *envelope) seal(dst, chunk []byte, index int64, last bool) ([]byte) {
+  return e.aead.Seal(dst, e.nonce(index, last), chunk, nil)
+}
+
+func (e *envelope) open(dst, chunk []byte, index int64, last bool) ([]byte, error) {
+  return e.aead.Open(dst, e.nonce(index, last), chunk, nil)
+}
+
+// An empty object is still one sealed chunk
+func envelopeChunkCount(plaintextSize int64) (int64) {
+  if plaintextSize <= 0 {
+    return 1
+  }
+
+  return (plaintextSize + envelopeChunkSize - 1) / envelopeChunkSize
+}
+
+func ciphertextSize(plaintextSize int64) (int64) {
+  return plaintextSize + envelopeChunkCount(plaintextSize) * envelopeTagSize
+}
+
+func plaintextSize(ciphertextSize int64) (int64) {
+  sealed := envelopeChunkSize + envelopeTagSize
+  size := ciphertextSize - (ciphertextSize + sealed - 1) / sealed * envelopeTagSize
+  if size < 0 {
+    return 0
+  }
+
+  return size
+}
+
+// Seals what's written to it a chunk at a time. A full chunk is held back
+// until more arrives since only close knows which chunk is the last.
+type chunkSealer struct {
+  *envelope
+  pending []byte
+  index int64
+}
+
+func (s *chunkSealer) write(data []byte) ([]byte) {
+  s.pending = append(s.pending, data...)
+
+  var sealed []byte
+  for int64(len(s.pending)) > envelopeChunkSize {
+    sealed = s.seal(sealed, s.pending[:envelopeChunkSize], s.index, false)
+    s.pending = s.pending[envelopeChunkSize:]
+    s.index++
+  }
+
+  return sealed
+}
+
+func (s *chunkSealer) close() ([]byte) {
+  sealed := s.seal(nil, s.pending, s.index, true)
+  s.pending = nil
+  s.index++
+
+  return sealed
+}
+
+// Give the writer a new data key, the wrapped copy goes in the metadata of
+// the object it uploads.
+func (w *multipartWriter) encryptClientSide(ctx context.Context) (error) {
+  if masterKey == nil {
+    return errNoMasterKey
+  }
+
+  key := make([]byte, 32)
+  if _, err := io.ReadFull(rand.Reader, key); err != nil {
+    return err
+  }
+
+  wrapped, err := masterKey.wrap(ctx, key)
+  if err != nil {
+    return err
+  }
+
+  env, err := newEnvelope(key)
+  if err != nil {
+    return err
+  }
+
+  w.sealer = &chunkSealer{envelope: env}
+
+  if w.metadata == nil {
+    w.metadata = make(map[string]*string)
+  }
+  w.metadata[envelopeVersionHeader] = aws.String(envelopeVersion)
+  w.metadata[wrappedKeyHeader] = aws.String(wrapped)
+  w.metadata[masterKeyHeader] = aws.String(masterKey.id())
+
+  return nil
+}
+
+// S3 hands metadata back with its keys canonicalized however the SDK felt
+func metadataValue(metadata map[string]*string, name string) (string) {
+  for k, v := range metadata {
+    if strings.EqualFold(k, name) {
+      return aws.StringValue(v)
+    }
+  }
+
+  return ""
+}
+
+func isEnvelope(metadata map[string]*string) (bool) {
+  return metadataValue(metadata, wrappedKeyHeader) != ""
+}
+
+// Listings don't include metadata, so on a client-side encrypted mount each
+// listed object is looked at to report envelopes at their plaintext size the
+// way Stat does. Objects that can't be looked at keep their stored size.
+func (fs *s3fs) envelope_sizes(ctx context.Context, files map[string]*s3File) {
+  var wg sync.WaitGroup
+  slots := make(chan struct{}, envelopeHeadConcurrency)
+
+  for _, f := range files {
+    if f.isdir {
+      continue
+    }
+
+    slots <- struct{}{}
+    wg.Add(1)
+
+    go func(f *s3File) {
+      defer wg.Done()
+      defer func() { <-slots }()
+
+      input := &s3.HeadObjectInput{
+        Bucket: aws.String(f.bucket),
+        Key: aws.String(f.key),
+        VersionId: f.version(),
+      }
+      fs.encryption_for(f.bucket).applyToHead(input)
+
+      output, err := fs.HeadObjectWithContext(ctx, input)
+      if err != nil {
+        fs.log.Debug("could not tell if object is encrypted", "bucket", f.bucket, "key", f.key, "error", err)
+        return
+      }
+
+      if isEnvelope(output.Metadata) {
+        f.size = plaintextSize(aws.Int64Value(output.ContentLength))
+      }
+    }(f)
+  }
+
+  wg.Wait()
+}
+
+// The object's data key when it was encrypted client-side, nil otherwise.
+// Leaves f.size as the size of the plaintext.
+func (f *s3File) open_envelope(ctx context.Context) (*envelope, error) {
+  input := &s3.HeadObjectInput{
+    Bucket: aws.String(f.bucket),
+    Key: aws.String(f.key),
+    VersionId: f.version(),
+  }
+  f.encryption_for(f.bucket).applyToHead(input)
+
+  output, err := f.HeadObjectWithContext(ctx, input)
+  if err != nil {
+    return nil, err
+  }
+
+  f.size = aws.Int64Value(output.ContentLength)
+
+  if !isEnvelope(output.Metadata) {
+    return nil, nil
+  }
+
+  // never hand out the ciphertext as if it were the file
+  if masterKey == nil {
+    return nil, errNoMasterKey
+  }
+
+  if metadataValue(output.Metadata, masterKeyHeader) != masterKey.id() {
+    return nil, errWrongMasterKey
+  }
+
+  key, err := masterKey.unwrap(ctx, metadataValue(output.Metadata, wrappedKeyHeader))
+  if err != nil {
+    return nil, err
+  }
+
+  f.size = plaintextSize(f.size)
+
+  return newEnvelope(key)
+}
+
+// Turn plaintext ranges into GETs of the chunks that cover them
+func (e *envelope) decryptRanges(getRange func(context.Context, int64, int64) (io.ReadCloser, error), size int64) (func(context.Context, int64, int64) (io.ReadCloser, error)) {
+  lastChunk := envelopeChunkCount(size) - 1
+  sealedSize := envelopeChunkSize + envelopeTagSize
+
+  return func(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+    first := offset / envelopeChunkSize
+    last := (offset + length - 1) / envelopeChunkSize
+    if last > lastChunk {
+      last = lastChunk
+    }
+    if first > last {
+      return ioutil.NopCloser(bytes.NewReader(nil)), nil
+    }
+
+    body, err := getRange(ctx, first * sealedSize, (last - first + 1) * sealedSize)
+    if err != nil {
+      return nil, err
+    }
+    sealed, err := ioutil.ReadAll(body)
+    body.Close()
+    if err != nil {
+      return nil, err
+    }
+
+    plain := make([]byte, 0, (last - first + 1) * envelopeChunkSize)
+    for index := first; index <= last && len(sealed) > 0; index++ {
+      n := int64(len(sealed))
+      if n > sealedSize {
+        n = sealedSize
+      }
+
+      if plain, err = e.open(plain, sealed[:n], index, index == lastChunk); err != nil {
+        return nil, err
+      }
+      sealed = sealed[n:]
+    }
+
+    skip := offset - first * envelopeChunkSize
+    if skip > int64(len(plain)) {
+      skip = int64(len(plain))
+    }
+    end := skip + length
+    if end > int64(len(plain)) {
+      end = int64(len(plain))
+    }
+
+    return ioutil.NopCloser(bytes.NewReader(plain[skip:end])), nil
+  }
+}
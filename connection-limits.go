@@ -0,0 +1,223 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "sync"
+  "sync/atomic"
+  "time"
+
+  "golang.org/x/crypto/ssh"
+)
+
+var (
+  maxConnections int
+  maxConnectionsPerUser int
+  handshakeTimeoutSeconds int
+  keepaliveIntervalSeconds int
+  keepaliveMaxMissed int
+  idleTimeoutMinutes int
+  maxSessionMinutes int
+)
+
+func init() {
+  setFromENV("MAX_CONNECTIONS", &maxConnections, 0)
+  setFromENV("MAX_CONNECTIONS_PER_USER", &maxConnectionsPerUser, 0)
+  setFromENV("HANDSHAKE_TIMEOUT_SECONDS", &handshakeTimeoutSeconds, 30)
+  setFromENV("KEEPALIVE_INTERVAL_SECONDS", &keepaliveIntervalSeconds, 30)
+  setFromENV("KEEPALIVE_MAX_MISSED", &keepaliveMaxMissed, 3)
+  setFromENV("IDLE_TIMEOUT_MINUTES", &idleTimeoutMinutes, 30)
+  setFromENV("MAX_SESSION_MINUTES", &maxSessionMinutes, 0)
+}
+
+var (
+  errTooManyConnections = errors.New("too many connections to the server, try again later")
+  errKeepaliveTimeout = errors.New("keepalive timed out")
+)
+
+// Counts authenticated connections globally and per access key, a limit of 0
+// means unlimited. The per user limit comes from the user's plan.
+type connectionLimiter struct {
+  total int
+  perUser map[string]int
+  lock sync.Mutex
+}
+
+var limiter = &connectionLimiter{perUser: make(map[string]int)}
+
+func (l *connectionLimiter) acquire(accessKey string, perUserLimit int) (error) {
+  l.lock.Lock()
+  defer l.lock.Unlock()
+
+  if maxConnections > 0 && l.total >= maxConnections {
+    rejectedConnections.WithLabelValues("global").Inc()
+    return errTooManyConnections
+  }
+
+  if perUserLimit > 0 && l.perUser[accessKey] >= perUserLimit {
+    rejectedConnections.WithLabelValues("per_user").Inc()
+    return fmt.Errorf("too many connections for %s, at most %d are allowed at once", accessKey, perUserLimit)
+  }
+
+  l.total++
+  l.perUser[accessKey]++
+  connectedClientsPerUser.WithLabelValues(accessKey).Inc()
+
+  return nil
+}
+
+func (l *connectionLimiter) release(accessKey string) {
+  l.lock.Lock()
+  defer l.lock.Unlock()
+
+  l.total--
+  l.perUser[accessKey]--
+  connectedClientsPerUser.WithLabelValues(accessKey).Dec()
+
+  if l.perUser[accessKey] <= 0 {
+    delete(l.perUser, accessKey)
+    connectedClientsPerUser.DeleteLabelValues(accessKey)
+  }
+}
+
+// Watches an established connection and closes it when the client stops
+// answering keepalives, goes idle for too long or reaches the maximum session
+// length.
+type sessionWatchdog struct {
+  conn ssh.Conn
+  started time.Time
+  lastActivity int64 // unix nanoseconds, accessed atomically
+  channel io.Writer
+  channelLock sync.Mutex
+  done chan struct{}
+}
+
+func watchSession(conn ssh.Conn) (*sessionWatchdog) {
+  w := &sessionWatchdog{
+    conn: conn,
+    started: time.Now(),
+    lastActivity: time.Now().UnixNano(),
+    done: make(chan struct{}),
+  }
+
+  go w.run()
+
+  return w
+}
+
+// Wrap a session channel so reads from the client count as activity and so
+// we can tell the client why we're hanging up on them.
+func (w *sessionWatchdog) track(channel ssh.Channel) (io.ReadWriteCloser) {
+  w.channelLock.Lock()
+  w.channel = channel.Stderr()
+  w.channelLock.Unlock()
+
+  return &activityChannel{channel, w}
+}
+
+func (w *sessionWatchdog) stop() {
+  close(w.done)
+}
+
+// KEEPALIVE_INTERVAL_SECONDS of 0 or less turns keepalives off, the timeouts
+// are still checked this often
+const watchdogCheckInterval = 30 * time.Second
+
+func watchdogInterval() (time.Duration) {
+  if keepaliveIntervalSeconds <= 0 {
+    return watchdogCheckInterval
+  }
+
+  return time.Duration(keepaliveIntervalSeconds) * time.Second
+}
+
+func (w *sessionWatchdog) run() {
+  ticker := time.NewTicker(watchdogInterval())
+  defer ticker.Stop()
+
+  missed := 0
+  idleTimeout := time.Duration(idleTimeoutMinutes) * time.Minute
+  maxSession := time.Duration(maxSessionMinutes) * time.Minute
+
+  for {
+    select {
+    case <-w.done:
+      return
+    case <-ticker.C:
+    }
+
+    if maxSession > 0 && time.Since(w.started) > maxSession {
+      w.disconnect("max_duration", "maximum session length reached")
+      return
+    }
+
+    last := time.Unix(0, atomic.LoadInt64(&w.lastActivity))
+    if idleTimeout > 0 && time.Since(last) > idleTimeout {
+      w.disconnect("idle", "idle timeout")
+      return
+    }
+
+    if keepaliveIntervalSeconds <= 0 {
+      continue
+    }
+
+    if err := w.keepalive(); err != nil {
+      missed++
+      if missed >= keepaliveMaxMissed {
+        w.disconnect("keepalive", "no response to keepalives")
+        return
+      }
+    } else {
+      missed = 0
+    }
+  }
+}
+
+// Any reply, even a failure, means the client is still there
+func (w *sessionWatchdog) keepalive() (error) {
+  result := make(chan error, 1)
+
+  go func() {
+    _, _, err := w.conn.SendRequest("keepalive@openssh.com", true, nil)
+    result <- err
+  }()
+
+  select {
+  case err := <-result:
+    return err
+  case <-time.After(time.Duration(keepaliveIntervalSeconds) * time.Second):
+    return errKeepaliveTimeout
+  }
+}
+
+func (w *sessionWatchdog) disconnect(reason, message string) {
+  sessionDisconnects.WithLabelValues(reason).Inc()
+  logger.Info("disconnecting", "access_key_id", w.conn.User(), "remote_addr", w.conn.RemoteAddr().String(), "reason", reason, "message", message)
+
+  w.channelLock.Lock()
+  if w.channel != nil {
+    fmt.Fprintf(w.channel, "s3tp: disconnecting, %s\n", message)
+  }
+  w.channelLock.Unlock()
+
+  w.conn.Close()
+}
+
+func (w *sessionWatchdog) touch() {
+  atomic.StoreInt64(&w.lastActivity, time.Now().UnixNano())
+}
+
+type activityChannel struct {
+  ssh.Channel
+  watchdog *sessionWatchdog
+}
+
+func (c *activityChannel) Read(data []byte) (int, error) {
+  n, err := c.Channel.Read(data)
+  if n > 0 {
+    c.watchdog.touch()
+  }
+
+  return n, err
+}
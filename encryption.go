@@ -0,0 +1,287 @@
+package main
+
+import (
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/rand"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "os"
+
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/request"
+  "github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+  sseS3 = "sse-s3"
+  sseKMS = "sse-kms"
+  sseC = "sse-c"
+)
+
+var errNoCustomerKeyMaster = errors.New("SSE_C_MASTER_KEY is needed to use SSE-C keys")
+
+// Server-wide defaults for users and buckets without settings of their own.
+// SSE_MODE is sse-s3 or sse-kms, SSE-C keys only come from the database.
+var defaultEncryption *encryptionSettings
+
+// SSE-C keys are stored sealed with this key, see sealKey
+var customerKeyMaster []byte
+
+// Read the server-wide settings, SSE_MODE is checked up front so that a typo
+// doesn't quietly leave uploads unencrypted.
+func loadDefaultEncryption() (error) {
+  var err error
+
+  if master := os.Getenv("SSE_C_MASTER_KEY"); master != "" {
+    customerKeyMaster, err = base64.StdEncoding.DecodeString(master)
+    if err != nil || len(customerKeyMaster) != 32 {
+      return errors.New("SSE_C_MASTER_KEY must be 32 bytes, base64 encoded")
+    }
+  }
+
+  if err := loadMasterKey(); err != nil {
+    return err
+  }
+
+  if os.Getenv("SSE_MODE") == sseC {
+    return errors.New("SSE_MODE can't be sse-c, customer keys are set per user")
+  }
+
+  defaultEncryption, err = newEncryptionSettings(os.Getenv("SSE_MODE"), os.Getenv("SSE_KMS_KEY_ID"), os.Getenv("SSE_KMS_CONTEXT"), "", clientSideEncryption != 0)
+
+  return err
+}
+
+// How objects are encrypted at rest, a nil *encryptionSettings leaves it to
+// the bucket's default encryption.
+type encryptionSettings struct {
+  mode string
+  kmsKeyID string
+  kmsContext string // base64 encoded JSON, the way S3 wants it
+  customerKey []byte
+  clientSide bool // encrypt before it leaves us, see client-encryption.go
+}
+
+func newEncryptionSettings(mode, kmsKeyID, kmsContext, sealedCustomerKey string, clientSide bool) (*encryptionSettings, error) {
+  e := &encryptionSettings{mode: mode}
+
+  switch mode {
+  case "":
+    if !clientSide {
+      return nil, nil
+    }
+  case "none":
+  case sseS3:
+  case sseKMS:
+    e.kmsKeyID = kmsKeyID
+
+    if kmsContext != "" {
+      var context map[string]string
+      if err := json.Unmarshal([]byte(kmsContext), &context); err != nil {
+        return nil, fmt.Errorf("KMS encryption context must be a JSON object of strings: %v", err)
+      }
+      e.kmsContext = base64.StdEncoding.EncodeToString([]byte(kmsContext))
+    }
+  case sseC:
+    key, err := unsealCustomerKey(sealedCustomerKey)
+    if err != nil {
+      return nil, err
+    }
+    e.customerKey = key
+  default:
+    return nil, fmt.Errorf("unknown encryption mode %q", mode)
+  }
+
+  if clientSide {
+    if masterKey == nil {
+      return nil, errNoMasterKey
+    }
+    e.clientSide = true
+  }
+
+  return e, nil
+}
+
+// The user's settings keyed by bucket, "" applies to every bucket they don't
+// have specific settings for
+func loadEncryptionSettings(accessKey string) (map[string]*encryptionSettings, error) {
+  settings := make(map[string]*encryptionSettings)
+
+  if db == nil {
+    return settings, nil
+  }
+
+  var query = `
+    SELECT bucket, mode, kms_key_id, COALESCE(kms_context::text, ''), customer_key, client_side
+    FROM encryption_settings
+    WHERE access_key_id = $1;
+  `
+
+  rows, err := db.Query(query, accessKey)
+  if err != nil {
+    return settings, err
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    var bucket, mode, kmsKeyID, kmsContext, customerKey string
+    var clientSide bool
+
+    if err := rows.Scan(&bucket, &mode, &kmsKeyID, &kmsContext, &customerKey, &clientSide); err != nil {
+      return settings, err
+    }
+
+    e, err := newEncryptionSettings(mode, kmsKeyID, kmsContext, customerKey, clientSide)
+    if err != nil {
+      return settings, fmt.Errorf("encryption settings for %q: %v", bucket, err)
+    }
+    settings[bucket] = e
+  }
+
+  return settings, rows.Err()
+}
+
+func (fs *s3fs) encryption_for(bucket string) (*encryptionSettings) {
+  if e, ok := fs.encryption[bucket]; ok {
+    return e
+  }
+
+  if e, ok := fs.encryption[""]; ok {
+    return e
+  }
+
+  return defaultEncryption
+}
+
+// SSE-C keys are kept as base64(nonce || AES-256-GCM ciphertext) under
+// SSE_C_MASTER_KEY so the database never holds them in the clear.
+func sealKey(master, key []byte) (string, error) {
+  gcm, err := newGCM(master)
+  if err != nil {
+    return "", err
+  }
+
+  nonce := make([]byte, gcm.NonceSize())
+  if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+    return "", err
+  }
+
+  return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, key, nil)), nil
+}
+
+func openSealedKey(master []byte, sealed string) ([]byte, error) {
+  data, err := base64.StdEncoding.DecodeString(sealed)
+  if err != nil {
+    return nil, err
+  }
+
+  gcm, err := newGCM(master)
+  if err != nil {
+    return nil, err
+  }
+
+  if len(data) < gcm.NonceSize() {
+    return nil, errors.New("sealed key is too short")
+  }
+
+  return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func unsealCustomerKey(sealed string) ([]byte, error) {
+  if customerKeyMaster == nil {
+    return nil, errNoCustomerKeyMaster
+  }
+
+  key, err := openSealedKey(customerKeyMaster, sealed)
+  if err != nil {
+    return nil, err
+  }
+
+  if len(key) != 32 {
+    return nil, errors.New("customer keys must be 32 bytes")
+  }
+
+  return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+  block, err := aes.NewCipher(key)
+  if err != nil {
+    return nil, err
+  }
+
+  return cipher.NewGCM(block)
+}
+
+// The headers that pick how a new object is encrypted
+func (e *encryptionSettings) serverSide() (sse, kmsKeyID *string) {
+  switch {
+  case e == nil:
+  case e.mode == sseS3:
+    sse = aws.String(s3.ServerSideEncryptionAes256)
+  case e.mode == sseKMS:
+    sse = aws.String(s3.ServerSideEncryptionAwsKms)
+    if e.kmsKeyID != "" {
+      kmsKeyID = aws.String(e.kmsKeyID)
+    }
+  }
+
+  return
+}
+
+// The SDK we're locked to has no field for the KMS encryption context, so
+// requests that create an object set the header themselves.
+func (e *encryptionSettings) requestOptions() ([]request.Option) {
+  if e == nil || e.mode != sseKMS || e.kmsContext == "" {
+    return nil
+  }
+
+  return []request.Option{func(r *request.Request) {
+    r.Handlers.Build.PushBack(func(r *request.Request) {
+      r.HTTPRequest.Header.Set("X-Amz-Server-Side-Encryption-Context", e.kmsContext)
+    })
+  }}
+}
+
+// The headers every request touching an SSE-C object's data needs, the SDK
+// encodes the key and works out its MD5.
+func (e *encryptionSettings) customer() (algorithm, key *string) {
+  if e == nil || e.mode != sseC {
+    return nil, nil
+  }
+
+  return aws.String("AES256"), aws.String(string(e.customerKey))
+}
+
+func (e *encryptionSettings) applyToCreate(input *s3.CreateMultipartUploadInput) {
+  input.ServerSideEncryption, input.SSEKMSKeyId = e.serverSide()
+  input.SSECustomerAlgorithm, input.SSECustomerKey = e.customer()
+}
+
+func (e *encryptionSettings) applyToPut(input *s3.PutObjectInput) {
+  input.ServerSideEncryption, input.SSEKMSKeyId = e.serverSide()
+  input.SSECustomerAlgorithm, input.SSECustomerKey = e.customer()
+}
+
+func (e *encryptionSettings) applyToPart(input *s3.UploadPartInput) {
+  input.SSECustomerAlgorithm, input.SSECustomerKey = e.customer()
+}
+
+func (e *encryptionSettings) applyToGet(input *s3.GetObjectInput) {
+  input.SSECustomerAlgorithm, input.SSECustomerKey = e.customer()
+}
+
+func (e *encryptionSettings) applyToHead(input *s3.HeadObjectInput) {
+  input.SSECustomerAlgorithm, input.SSECustomerKey = e.customer()
+}
+
+// e is how the copy should be encrypted, source how the original is
+func (e *encryptionSettings) applyToCopy(input *s3.CopyObjectInput, source *encryptionSettings) {
+  input.ServerSideEncryption, input.SSEKMSKeyId = e.serverSide()
+  input.SSECustomerAlgorithm, input.SSECustomerKey = e.customer()
+  input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey = source.customer()
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+  "bytes"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/sqs"
+  "github.com/lib/pq"
+)
+
+// Somewhere events end up. Write is called with batches from a single
+// goroutine per sink, an error means the whole batch is retried and then
+// spooled unless it's a partialWriteError.
+type EventSink interface {
+  Name() string
+  Write(batch []*event) error
+}
+
+// Returned by sinks that wrote part of a batch, only the unsent events are
+// retried so the rest aren't delivered twice
+type partialWriteError struct {
+  unsent []*event
+  err error
+}
+
+func (e *partialWriteError) Error() string {
+  return e.err.Error()
+}
+
+var errNoDatabase = errors.New("no database connection")
+
+// EVENT_SINKS is a comma separated list of sinks, e.g. "postgres,webhook".
+// It defaults to postgres when there's a database and to no sinks at all,
+// i.e. no accounting, when there isn't. A sink that's unknown or can't be set
+// up is an error rather than silently losing its events.
+func configuredEventSinks() ([]EventSink, error) {
+  hasDatabase := DatabaseURL != ""
+
+  names := os.Getenv("EVENT_SINKS")
+  if names == "" && hasDatabase {
+    names = "postgres"
+  }
+
+  var sinks []EventSink
+
+  for _, name := range strings.Split(names, ",") {
+    var sink EventSink
+    var err error
+
+    switch strings.TrimSpace(name) {
+    case "postgres":
+      if !hasDatabase {
+        err = errors.New("the postgres event sink needs DATABASE_URL")
+      }
+      sink = &postgresSink{}
+    case "json":
+      sink, err = newJSONSink(os.Getenv("EVENT_JSON_PATH"))
+    case "webhook":
+      sink, err = newWebhookSink(os.Getenv("EVENT_WEBHOOK_URL"), os.Getenv("EVENT_WEBHOOK_SECRET"))
+    case "sqs":
+      sink, err = newSQSSink(os.Getenv("EVENT_SQS_QUEUE_URL"), os.Getenv("EVENT_SQS_ENDPOINT"))
+    case "":
+      continue
+    default:
+      err = fmt.Errorf("unknown event sink %q", name)
+    }
+
+    if err != nil {
+      return nil, err
+    }
+
+    sinks = append(sinks, sink)
+  }
+
+  return sinks, nil
+}
+
+// Writes events to the events table
+type postgresSink struct{}
+
+func (s *postgresSink) Name() string {
+  return "postgres"
+}
+
+func (s *postgresSink) Write(batch []*event) (error) {
+  if db == nil {
+    return errNoDatabase
+  }
+
+  txn, err := db.Begin()
+  if err != nil {
+    return err
+  }
+
+  stmt, err := txn.Prepare(pq.CopyIn(
+    "events",
+    "session_id",
+    "access_key_id",
+    "type",
+    "size",
+    "created_at",
+    "bucket",
+    "object_key",
+    "remote_addr",
+    "client_version",
+    "started_at",
+    "ended_at",
+    "outcome",
+    "error_class",
+    "old_path",
+    "new_path",
+  ))
+  if err != nil {
+    txn.Rollback()
+    return err
+  }
+
+  for _, e := range batch {
+    _, err := stmt.Exec(
+      e.SessionID,
+      e.AccessKey,
+      e.Category,
+      e.Size,
+      e.CreatedAt,
+      nullString(e.Bucket),
+      nullString(e.Key),
+      nullString(e.RemoteAddr),
+      nullString(e.ClientVersion),
+      nullTime(e.StartedAt),
+      nullTime(e.EndedAt),
+      nullString(e.Outcome),
+      nullString(e.ErrorClass),
+      nullString(e.OldPath),
+      nullString(e.NewPath),
+    )
+    if err != nil {
+      stmt.Close()
+      txn.Rollback()
+      return err
+    }
+  }
+
+  if _, err := stmt.Exec(); err != nil {
+    stmt.Close()
+    txn.Rollback()
+    return err
+  }
+
+  if err := stmt.Close(); err != nil {
+    txn.Rollback()
+    return err
+  }
+
+  return txn.Commit()
+}
+
+func nullString(s string) (interface{}) {
+  if s == "" {
+    return nil
+  }
+  return s
+}
+
+func nullTime(t time.Time) (interface{}) {
+  if t.IsZero() {
+    return nil
+  }
+  return t
+}
+
+// Writes newline delimited JSON to a file, or stdout when no path is given
+type jsonSink struct {
+  out io.Writer
+  lock sync.Mutex
+}
+
+func newJSONSink(path string) (*jsonSink, error) {
+  if path == "" || path == "-" {
+    return &jsonSink{out: os.Stdout}, nil
+  }
+
+  file, err := os.OpenFile(path, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0600)
+  if err != nil {
+    return nil, err
+  }
+
+  return &jsonSink{out: file}, nil
+}
+
+func (s *jsonSink) Name() string {
+  return "json"
+}
+
+func (s *jsonSink) Write(batch []*event) (error) {
+  s.lock.Lock()
+  defer s.lock.Unlock()
+
+  var buffer bytes.Buffer
+  encoder := json.NewEncoder(&buffer)
+
+  for _, e := range batch {
+    if err := encoder.Encode(e); err != nil {
+      return err
+    }
+  }
+
+  _, err := s.out.Write(buffer.Bytes())
+
+  return err
+}
+
+// POSTs each batch as a JSON array. When a secret is configured the request
+// carries X-S3tp-Timestamp and X-S3tp-Signature headers, the signature is the
+// hex HMAC-SHA256 of "<timestamp>.<body>".
+type webhookSink struct {
+  url string
+  secret []byte
+  client *http.Client
+}
+
+func newWebhookSink(url, secret string) (*webhookSink, error) {
+  if url == "" {
+    return nil, errors.New("EVENT_WEBHOOK_URL is required for the webhook sink")
+  }
+
+  return &webhookSink{
+    url: url,
+    secret: []byte(secret),
+    client: &http.Client{Timeout: 10 * time.Second},
+  }, nil
+}
+
+func (s *webhookSink) Name() string {
+  return "webhook"
+}
+
+func (s *webhookSink) Write(batch []*event) (error) {
+  body, err := json.Marshal(batch)
+  if err != nil {
+    return err
+  }
+
+  return postSigned(s.client, s.url, s.secret, body)
+}
+
+// POST a JSON body, signing it when there's a secret. Anything but a 2xx
+// response is an error.
+func postSigned(client *http.Client, url string, secret []byte, body []byte) (error) {
+  request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+  if err != nil {
+    return err
+  }
+
+  request.Header.Set("Content-Type", "application/json")
+
+  if len(secret) > 0 {
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    request.Header.Set("X-S3tp-Timestamp", timestamp)
+    request.Header.Set("X-S3tp-Signature", "sha256=" + signPayload(secret, timestamp, body))
+  }
+
+  response, err := client.Do(request)
+  if err != nil {
+    return err
+  }
+  defer response.Body.Close()
+  io.Copy(ioutil.Discard, response.Body)
+
+  if response.StatusCode < 200 || response.StatusCode >= 300 {
+    return fmt.Errorf("%s responded with %s", url, response.Status)
+  }
+
+  return nil
+}
+
+func signPayload(secret []byte, timestamp string, body []byte) (string) {
+  mac := hmac.New(sha256.New, secret)
+  mac.Write([]byte(timestamp))
+  mac.Write([]byte("."))
+  mac.Write(body)
+
+  return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sends one message per event to an SQS queue. EVENT_SQS_ENDPOINT points the
+// client at a local stand-in such as ElasticMQ, credentials come from the
+// usual AWS environment variables.
+type sqsSink struct {
+  client *sqs.SQS
+  queueURL string
+}
+
+// SQS takes at most 10 messages in a batch
+const sqsMaxBatch = 10
+
+func newSQSSink(queueURL, endpoint string) (*sqsSink, error) {
+  if queueURL == "" {
+    return nil, errors.New("EVENT_SQS_QUEUE_URL is required for the sqs sink")
+  }
+
+  region := os.Getenv("EVENT_SQS_REGION")
+  if region == "" {
+    region = "us-east-1"
+  }
+
+  config := &aws.Config{Region: aws.String(region)}
+  if endpoint != "" {
+    config.Endpoint = aws.String(endpoint)
+  }
+
+  sess, err := session.NewSession(config)
+  if err != nil {
+    return nil, err
+  }
+
+  return &sqsSink{client: sqs.New(sess), queueURL: queueURL}, nil
+}
+
+func (s *sqsSink) Name() string {
+  return "sqs"
+}
+
+func (s *sqsSink) Write(batch []*event) (error) {
+  var unsent []*event
+  var lastErr error
+
+  for start := 0; start < len(batch); start += sqsMaxBatch {
+    end := start + sqsMaxBatch
+    if end > len(batch) {
+      end = len(batch)
+    }
+
+    var entries []*sqs.SendMessageBatchRequestEntry
+
+    for i, e := range batch[start:end] {
+      body, err := json.Marshal(e)
+      if err != nil {
+        return err
+      }
+
+      entries = append(entries, &sqs.SendMessageBatchRequestEntry{
+        Id: aws.String(strconv.Itoa(start + i)),
+        MessageBody: aws.String(string(body)),
+      })
+    }
+
+    output, err := s.client.SendMessageBatch(&sqs.SendMessageBatchInput{
+      QueueUrl: aws.String(s.queueURL),
+      Entries: entries,
+    })
+    if err != nil {
+      unsent = append(unsent, batch[start:]...)
+      lastErr = err
+      break
+    }
+
+    for _, failed := range output.Failed {
+      i, err := strconv.Atoi(aws.StringValue(failed.Id))
+      if err != nil || i < start || i >= end {
+        return fmt.Errorf("sqs rejected an unknown message %q: %s %s", aws.StringValue(failed.Id), aws.StringValue(failed.Code), aws.StringValue(failed.Message))
+      }
+
+      unsent = append(unsent, batch[i])
+      lastErr = fmt.Errorf("sqs rejected %d events: %s %s", len(output.Failed), aws.StringValue(failed.Code), aws.StringValue(failed.Message))
+    }
+  }
+
+  if len(unsent) == len(batch) {
+    return lastErr
+  }
+  if len(unsent) > 0 {
+    return &partialWriteError{unsent: unsent, err: lastErr}
+  }
+
+  return nil
+}
@@ -1,51 +1,457 @@
 package main
 
 import (
-  "log"
+  "bufio"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "os"
+  "path/filepath"
+  "sync"
+  "time"
 
+  "github.com/aws/aws-sdk-go/aws/awserr"
   "github.com/satori/go.uuid"
 )
 
+var (
+  eventQueueSize int
+  eventBatchSize int
+  eventFlushIntervalMS int
+  eventMaxRetries int
+  eventReplayBackoffSeconds int
+  eventSpoolPath string
+)
+
+func init() {
+  setFromENV("EVENT_QUEUE_SIZE", &eventQueueSize, 10000)
+  setFromENV("EVENT_BATCH_SIZE", &eventBatchSize, 500)
+  setFromENV("EVENT_FLUSH_INTERVAL_MS", &eventFlushIntervalMS, 1000)
+  setFromENV("EVENT_MAX_RETRIES", &eventMaxRetries, 5)
+  setFromENV("EVENT_REPLAY_BACKOFF_SECONDS", &eventReplayBackoffSeconds, 30)
+
+  eventSpoolPath = os.Getenv("EVENT_SPOOL_PATH")
+  if eventSpoolPath == "" {
+    eventSpoolPath = "events.spool"
+  }
+}
+
 type event struct {
-  sessionID uuid.UUID
-  accessKey string
-  category string
-  size int64
-}
-
-func persist_event(sessionID uuid.UUID, accessKey string, category string, size int64) {
-  e := event{
-    sessionID,
-    accessKey,
-    category,
-    size,
-  }
-
-  e.persist()
-}
-
-func (e *event) persist() {
-  var sql = `
-    INSERT INTO events
-    (
-      session_id,
-      access_key_id,
-      type,
-      size
-    )
-    VALUES($1, $2, $3, $4);
-  `
-  _, err := db.Exec(sql, e.sessionID, e.accessKey, e.category, e.size)
+  SessionID uuid.UUID `json:"session_id"`
+  AccessKey string `json:"access_key_id"`
+  Category string `json:"type"`
+  Size int64 `json:"size"`
+  CreatedAt time.Time `json:"created_at"`
+
+  Bucket string `json:"bucket,omitempty"`
+  Key string `json:"object_key,omitempty"`
+  RemoteAddr string `json:"remote_addr,omitempty"`
+  ClientVersion string `json:"client_version,omitempty"`
+  StartedAt time.Time `json:"started_at"`
+  EndedAt time.Time `json:"ended_at"`
+  Outcome string `json:"outcome,omitempty"`
+  ErrorClass string `json:"error_class,omitempty"`
+  OldPath string `json:"old_path,omitempty"`
+  NewPath string `json:"new_path,omitempty"`
+}
+
+const (
+  outcomeOK = "ok"
+  outcomeError = "error"
+)
+
+// Fill in who, where and how it went, then queue the event
+func (fs *s3fs) persist_event(e *event, err error) {
+  e.SessionID = fs.sessionID
+  e.AccessKey = fs.accessKey
+  e.RemoteAddr = fs.remoteAddr
+  e.ClientVersion = fs.clientVersion
+  e.EndedAt = time.Now()
+  e.CreatedAt = e.EndedAt
+
+  if e.StartedAt.IsZero() {
+    e.StartedAt = e.EndedAt
+  }
+
+  e.Outcome = outcomeOK
   if err != nil {
-    log.Println(
-      "Could not persist: ",
-      e.sessionID,
-      " ",
-      e.accessKey,
-      " ",
-      e.category,
-      " ",
-      e.size,
-    )
+    e.Outcome = outcomeError
+    e.ErrorClass = errorClass(err)
+  }
+
+  events.push(e)
+}
+
+// A short, bounded description of what went wrong
+func errorClass(err error) (string) {
+  switch err {
+  case errTransferQuotaExceeded:
+    return "quota"
+  case errMaxFileSizeExceeded:
+    return "file_size"
+  case errUnsupported:
+    return "unsupported"
+  case errUploadInterrupted:
+    return "interrupted"
+  }
+
+  if aerr, ok := err.(awserr.Error); ok {
+    return aerr.Code()
+  }
+
+  if os.IsNotExist(err) {
+    return "not_found"
+  }
+
+  return "internal"
+}
+
+// Hands every event to each of the configured sinks, each sink has its own
+// queue so a slow or broken one doesn't hold up the others.
+type eventDispatcher struct {
+  queues []*eventQueue
+}
+
+// no sinks until main has configured them
+var events = &eventDispatcher{}
+
+func newEventDispatcher(sinks []EventSink) (*eventDispatcher) {
+  d := &eventDispatcher{}
+
+  for _, sink := range sinks {
+    d.queues = append(d.queues, newEventQueue(sink, eventQueueSize))
+  }
+
+  return d
+}
+
+func (d *eventDispatcher) push(e *event) {
+  for _, q := range d.queues {
+    q.push(e)
+  }
+}
+
+func (d *eventDispatcher) has(name string) (bool) {
+  for _, q := range d.queues {
+    if q.sink.Name() == name {
+      return true
+    }
+  }
+  return false
+}
+
+func (d *eventDispatcher) run() {
+  for _, q := range d.queues {
+    go q.run()
+  }
+}
+
+func (d *eventDispatcher) close() {
+  for _, q := range d.queues {
+    q.close()
+  }
+}
+
+func (d *eventDispatcher) depth() (float64) {
+  var depth float64
+  for _, q := range d.queues {
+    depth += q.depth()
   }
+
+  return depth
+}
+
+// Events are queued in memory and written to a sink in batches. Batches that
+// can't be written after retrying are spooled to a local file and replayed
+// once the sink is back.
+type eventQueue struct {
+  sink EventSink
+  queue chan *event
+  overflow chan *event // events waiting to be spooled because queue was full
+  done chan struct{}
+  spillDone chan struct{}
+  closed bool
+  closeLock sync.RWMutex
+  spoolPath string
+  spoolLock sync.Mutex
+  lastFailure time.Time
+}
+
+func newEventQueue(sink EventSink, size int) (*eventQueue) {
+  q := &eventQueue{
+    sink: sink,
+    queue: make(chan *event, size),
+    overflow: make(chan *event, size),
+    done: make(chan struct{}),
+    spillDone: make(chan struct{}),
+    spoolPath: fmt.Sprintf("%s.%s", eventSpoolPath, sink.Name()),
+  }
+
+  go q.runSpill()
+
+  return q
+}
+
+// Never blocks the caller, when the queue is full the event is handed to the
+// spill goroutine to be spooled and is only dropped if that's backed up too.
+func (q *eventQueue) push(e *event) {
+  q.closeLock.RLock()
+  defer q.closeLock.RUnlock()
+
+  if q.closed {
+    // shutting down, there are no sessions left to hold up
+    q.spill([]*event{e})
+    return
+  }
+
+  select {
+  case q.queue <- e:
+  default:
+    select {
+    case q.overflow <- e:
+    default:
+      q.drop([]*event{e}, errors.New("spill queue full"))
+    }
+  }
+}
+
+// Spool overflowing events off the request path, a burst is one write
+func (q *eventQueue) runSpill() {
+  defer close(q.spillDone)
+
+  for e := range q.overflow {
+    batch := []*event{e}
+
+    for waiting := true; waiting && len(batch) < eventBatchSize; {
+      select {
+      case e, ok := <-q.overflow:
+        if !ok {
+          waiting = false
+          break
+        }
+        batch = append(batch, e)
+      default:
+        waiting = false
+      }
+    }
+
+    q.spill(batch)
+  }
+}
+
+func (q *eventQueue) spill(batch []*event) {
+  if err := q.spool(batch); err != nil {
+    q.drop(batch, err)
+  }
+}
+
+func (q *eventQueue) drop(batch []*event, err error) {
+  eventsDropped.WithLabelValues(q.sink.Name()).Add(float64(len(batch)))
+  for _, e := range batch {
+    logger.Error("could not persist event", "sink", q.sink.Name(), "session_id", e.SessionID.String(), "access_key_id", e.AccessKey, "type", e.Category, "bucket", e.Bucket, "key", e.Key, "size", e.Size, "error", err)
+  }
+}
+
+func (q *eventQueue) depth() (float64) {
+  return float64(len(q.queue))
+}
+
+func (q *eventQueue) run() {
+  defer close(q.done)
+
+  ticker := time.NewTicker(time.Duration(eventFlushIntervalMS) * time.Millisecond)
+  defer ticker.Stop()
+
+  // replays interrupted by a crash, or whose file couldn't be read last time
+  leftovers, _ := filepath.Glob(q.spoolPath + ".*.replay")
+  for _, path := range leftovers {
+    q.replayFile(path)
+  }
+
+  batch := make([]*event, 0, eventBatchSize)
+
+  for {
+    select {
+    case e, ok := <-q.queue:
+      if !ok {
+        q.write(batch)
+        return
+      }
+
+      batch = append(batch, e)
+      if len(batch) >= eventBatchSize {
+        q.write(batch)
+        batch = make([]*event, 0, eventBatchSize)
+      }
+    case <-ticker.C:
+      if len(batch) > 0 {
+        q.write(batch)
+        batch = make([]*event, 0, eventBatchSize)
+      }
+      // not only when idle, or a steady trickle of events keeps the spool
+      // from ever being replayed
+      q.replay()
+    }
+  }
+}
+
+// Stop accepting events and wait for everything queued to be written
+func (q *eventQueue) close() {
+  q.closeLock.Lock()
+  q.closed = true
+  close(q.queue)
+  close(q.overflow)
+  q.closeLock.Unlock()
+
+  <-q.spillDone
+  <-q.done
+}
+
+func (q *eventQueue) write(batch []*event) {
+  if len(batch) == 0 {
+    return
+  }
+
+  backoff := 100 * time.Millisecond
+  var err error
+
+  for try := 0; try < eventMaxRetries; try++ {
+    if err = q.sink.Write(batch); err == nil {
+      eventsPersisted.WithLabelValues(q.sink.Name()).Add(float64(len(batch)))
+      return
+    }
+
+    if partial, ok := err.(*partialWriteError); ok {
+      eventsPersisted.WithLabelValues(q.sink.Name()).Add(float64(len(batch) - len(partial.unsent)))
+      batch = partial.unsent
+    }
+
+    time.Sleep(backoff)
+    backoff *= 2
+  }
+
+  q.lastFailure = time.Now()
+  logger.Warn("could not persist events, spooling", "sink", q.sink.Name(), "events", len(batch), "error", err)
+
+  if err := q.spool(batch); err != nil {
+    eventsDropped.WithLabelValues(q.sink.Name()).Add(float64(len(batch)))
+    logger.Error("could not spool events", "sink", q.sink.Name(), "events", len(batch), "error", err)
+  }
+}
+
+// Append events to the spool file, one JSON document per line
+func (q *eventQueue) spool(batch []*event) (error) {
+  q.spoolLock.Lock()
+  defer q.spoolLock.Unlock()
+
+  file, err := os.OpenFile(q.spoolPath, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0600)
+  if err != nil {
+    return err
+  }
+
+  encoder := json.NewEncoder(file)
+  for _, e := range batch {
+    if err := encoder.Encode(e); err != nil {
+      file.Close()
+      return err
+    }
+  }
+
+  if err := file.Sync(); err != nil {
+    file.Close()
+    return err
+  }
+
+  eventsSpooled.WithLabelValues(q.sink.Name()).Add(float64(len(batch)))
+
+  return file.Close()
+}
+
+// Move the spool file aside and try to write what's in it, whatever fails goes
+// back into a fresh spool.
+func (q *eventQueue) replay() {
+  if _, err := os.Stat(q.spoolPath); err != nil {
+    return
+  }
+
+  // no point churning the spool while the sink is still failing
+  backoff := time.Duration(eventReplayBackoffSeconds) * time.Second
+  if time.Since(q.lastFailure) < backoff {
+    return
+  }
+
+  replayPath := fmt.Sprintf("%s.%d.replay", q.spoolPath, time.Now().UnixNano())
+
+  q.spoolLock.Lock()
+  err := os.Rename(q.spoolPath, replayPath)
+  q.spoolLock.Unlock()
+
+  if os.IsNotExist(err) {
+    return
+  }
+  if err != nil {
+    logger.Error("could not replay spooled events", "sink", q.sink.Name(), "error", err)
+    return
+  }
+
+  q.replayFile(replayPath)
+}
+
+// Write the events in a spool file that's been moved aside, the file is kept
+// if it can't be read so the next start can try again.
+func (q *eventQueue) replayFile(replayPath string) {
+  spooled, err := readSpool(replayPath)
+  if err != nil {
+    logger.Error("could not read spooled events", "sink", q.sink.Name(), "path", replayPath, "error", err)
+    return
+  }
+
+  for start := 0; start < len(spooled); start += eventBatchSize {
+    end := start + eventBatchSize
+    if end > len(spooled) {
+      end = len(spooled)
+    }
+
+    if err := q.sink.Write(spooled[start:end]); err != nil {
+      q.lastFailure = time.Now()
+
+      unsent := spooled[start:]
+      if partial, ok := err.(*partialWriteError); ok {
+        eventsPersisted.WithLabelValues(q.sink.Name()).Add(float64(end - start - len(partial.unsent)))
+        unsent = append(partial.unsent, spooled[end:]...)
+      }
+
+      if err := q.spool(unsent); err != nil {
+        logger.Error("could not respool events", "sink", q.sink.Name(), "path", replayPath, "error", err)
+        return
+      }
+      break
+    }
+
+    eventsPersisted.WithLabelValues(q.sink.Name()).Add(float64(end - start))
+  }
+
+  os.Remove(replayPath)
+}
+
+func readSpool(path string) ([]*event, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+
+  var spooled []*event
+
+  scanner := bufio.NewScanner(file)
+  for scanner.Scan() {
+    e := &event{}
+    if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+      // a torn write at the end of the file, skip it
+      continue
+    }
+    spooled = append(spooled, e)
+  }
+
+  return spooled, scanner.Err()
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "strings"
+  "sync/atomic"
+  "time"
+
+  "github.com/pkg/sftp"
+)
+
+// LOG_FORMAT is json or logfmt (the default), LOG_LEVEL one of debug, info,
+// warn or error. Successful SFTP requests are logged at debug and only one in
+// every LOG_SAMPLE_EVERY of them, failures are always logged.
+var (
+  logLevel = new(slog.LevelVar)
+  logger *slog.Logger
+  logSampleEvery int
+  requestSampler *logSampler
+  logLevelErr error // main refuses to start with it, see init
+)
+
+func init() {
+  setFromENV("LOG_SAMPLE_EVERY", &logSampleEvery, 1)
+  requestSampler = &logSampler{every: uint64(logSampleEvery)}
+
+  if level := os.Getenv("LOG_LEVEL"); level != "" {
+    if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+      logLevel.Set(slog.LevelInfo)
+      logLevelErr = fmt.Errorf("LOG_LEVEL must be one of debug, info, warn or error, not %q", level)
+    }
+  }
+
+  logger = newLogger(os.Stderr, os.Getenv("LOG_FORMAT"))
+  slog.SetDefault(logger)
+}
+
+func newLogger(out io.Writer, format string) (*slog.Logger) {
+  options := &slog.HandlerOptions{Level: logLevel}
+
+  if strings.ToLower(format) == "json" {
+    return slog.New(slog.NewJSONHandler(out, options))
+  }
+
+  return slog.New(slog.NewTextHandler(out, options))
+}
+
+func fatal(msg string, args ...interface{}) {
+  logger.Error(msg, args...)
+  os.Exit(1)
+}
+
+// Lets through one in every n calls, n < 2 lets everything through
+type logSampler struct {
+  every uint64
+  count uint64
+}
+
+func (s *logSampler) sample() (bool) {
+  if s.every < 2 {
+    return true
+  }
+
+  return atomic.AddUint64(&s.count, 1) % s.every == 1
+}
+
+// Count, time and log an SFTP request. The method comes from the sftp package
+// so the metric label values are bounded.
+func (fs *s3fs) observe_request(r *sftp.Request, started time.Time, err error) {
+  outcome := outcomeOK
+  if err != nil {
+    outcome = outcomeError
+  }
+
+  duration := time.Since(started)
+
+  sftpOperations.WithLabelValues(r.Method, outcome).Inc()
+  sftpOperationDuration.WithLabelValues(r.Method).Observe(duration.Seconds())
+
+  if err != nil {
+    fs.log.Warn("request failed", "method", r.Method, "path", r.Filepath, "duration", duration, "error", err)
+  } else if requestSampler.sample() {
+    fs.log.Debug("request", "method", r.Method, "path", r.Filepath, "duration", duration)
+  }
+}
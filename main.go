@@ -2,21 +2,28 @@
 package main
 
 import (
+  "context"
   "database/sql"
   "flag"
   "fmt"
   "io"
   "io/ioutil"
-  "log"
+  "log/slog"
   "net"
   "net/http"
   "net/http/pprof"
   "os"
+  "os/signal"
+  "sync"
+  "syscall"
+  "time"
 
   _ "github.com/lib/pq"
   "github.com/pkg/sftp"
   "github.com/prometheus/client_golang/prometheus"
   "github.com/prometheus/client_golang/prometheus/promhttp"
+  "go.opentelemetry.io/otel/attribute"
+  "go.opentelemetry.io/otel/trace"
   "golang.org/x/crypto/ssh"
 )
 
@@ -25,19 +32,134 @@ var (
     Name: "connected_clients",
     Help: "Number of currently connected clients",
   })
+  connectedClientsPerUser = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+    Name: "connected_clients_per_user",
+    Help: "Number of currently connected clients by access key",
+  }, []string{"access_key_id"})
+  rejectedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "rejected_connections_total",
+    Help: "Connections turned away because a connection limit was reached",
+  }, []string{"limit"})
+  sessionDisconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "session_disconnects_total",
+    Help: "Sessions closed by the server because of a timeout",
+  }, []string{"reason"})
+  eventQueueDepth = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+    Name: "event_queue_depth",
+    Help: "Number of events waiting to be persisted",
+  }, func() float64 { return events.depth() })
+  eventsPersisted = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "events_persisted_total",
+    Help: "Events written to an event sink",
+  }, []string{"sink"})
+  eventsSpooled = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "events_spooled_total",
+    Help: "Events written to the local spool file because their sink was unavailable",
+  }, []string{"sink"})
+  eventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "events_dropped_total",
+    Help: "Events that could not be persisted or spooled",
+  }, []string{"sink"})
+  notificationsDelivered = prometheus.NewCounter(prometheus.CounterOpts{
+    Name: "upload_notifications_delivered_total",
+    Help: "Upload notifications accepted by a user's endpoint",
+  })
+  notificationsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+    Name: "upload_notifications_failed_total",
+    Help: "Upload notifications that ran out of retries",
+  })
+  sftpOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "sftp_operations_total",
+    Help: "SFTP requests handled by method and outcome",
+  }, []string{"method", "outcome"})
+  sftpOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+    Name: "sftp_operation_duration_seconds",
+    Help: "Time taken to handle an SFTP request, for Get and Put this is opening the transfer",
+    Buckets: prometheus.DefBuckets,
+  }, []string{"method"})
+  transferredBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "transferred_bytes_total",
+    Help: "Bytes read from or written to S3 on behalf of clients",
+  }, []string{"direction"})
+  transfersInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+    Name: "transfers_in_flight",
+    Help: "Files currently open for reading or writing",
+  }, []string{"direction"})
+  s3Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "s3_requests_total",
+    Help: "S3 API calls by operation and HTTP status, status is error when there was no response",
+  }, []string{"operation", "status"})
+  s3RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+    Name: "s3_request_duration_seconds",
+    Help: "Latency of S3 API calls including retries",
+    Buckets: prometheus.DefBuckets,
+  }, []string{"operation"})
+  authAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "auth_attempts_total",
+    Help: "Password authentication attempts by result",
+  }, []string{"result"})
+  metadataCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+    Name: "metadata_cache_requests_total",
+    Help: "Stat and List lookups in the metadata cache by result",
+  }, []string{"kind", "result"})
+  metadataCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+    Name: "metadata_cache_evictions_total",
+    Help: "Entries pushed out of a full metadata cache",
+  })
+  readAheadBuffersInUse = prometheus.NewGauge(prometheus.GaugeOpts{
+    Name: "read_ahead_buffers_in_use",
+    Help: "Download chunks being fetched or waiting to be read",
+  })
+  uploadBufferBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+    Name: "upload_buffer_bytes",
+    Help: "Memory set aside for upload parts being buffered or sent",
+  })
 )
 
 var db *sql.DB
 var DatabaseURL string
+var uploadStateDir string
+var shutdownTimeoutSeconds int
 
 func init() {
   prometheus.MustRegister(connectedClients)
+  prometheus.MustRegister(connectedClientsPerUser)
+  prometheus.MustRegister(rejectedConnections)
+  prometheus.MustRegister(sessionDisconnects)
+  prometheus.MustRegister(eventQueueDepth)
+  prometheus.MustRegister(eventsPersisted)
+  prometheus.MustRegister(eventsSpooled)
+  prometheus.MustRegister(eventsDropped)
+  prometheus.MustRegister(notificationsDelivered)
+  prometheus.MustRegister(notificationsFailed)
+  prometheus.MustRegister(sftpOperations)
+  prometheus.MustRegister(sftpOperationDuration)
+  prometheus.MustRegister(transferredBytes)
+  prometheus.MustRegister(transfersInFlight)
+  prometheus.MustRegister(s3Requests)
+  prometheus.MustRegister(s3RequestDuration)
+  prometheus.MustRegister(authAttempts)
+  prometheus.MustRegister(metadataCacheRequests)
+  prometheus.MustRegister(metadataCacheEvictions)
+  prometheus.MustRegister(readAheadBuffersInUse)
+  prometheus.MustRegister(uploadBufferBytes)
   DatabaseURL = os.Getenv("DATABASE_URL")
+
+  setFromENV("SHUTDOWN_TIMEOUT_SECONDS", &shutdownTimeoutSeconds, 30)
+
+  uploadStateDir = os.Getenv("UPLOAD_STATE_DIR")
+  if uploadStateDir == "" {
+    uploadStateDir = "uploads"
+  }
 }
 
+// Metrics and the admin API
 func servePrometheusMetrics() {
-  http.Handle("/metrics", promhttp.Handler())
-  log.Fatal(http.ListenAndServe(":8081", nil))
+  r := http.NewServeMux()
+  r.Handle("/metrics", promhttp.Handler())
+  registerAdminAPI(r)
+
+  fatal("metrics server stopped", "error", http.ListenAndServe(":8081", r))
 }
 
 func serveProfiling() {
@@ -63,44 +185,84 @@ func main() {
   flag.BoolVar(&debugStderr, "e", false, "debug to stderr")
   flag.Parse()
 
+  if logLevelErr != nil {
+    fatal("invalid logging settings", "error", logLevelErr)
+  }
+
+  if debugStderr {
+    logLevel.Set(slog.LevelDebug)
+  }
+
+  if flag.Arg(0) == "migrate" {
+    os.Exit(runMigrateCommand(flag.Args()[1:]))
+  }
+
   var err error
 
-  db, err = sql.Open("postgres", DatabaseURL)
-  defer db.Close()
+  // Postgres is optional, without it there's no accounting or plans and
+  // upload state for resuming lives on local disk.
+  if DatabaseURL != "" {
+    db, err = sql.Open("postgres", DatabaseURL)
+    if err != nil {
+      fatal("failed to open database", "error", err)
+    }
+    defer db.Close()
+  } else {
+    logger.Info("DATABASE_URL is not set, running without a database")
 
+    uploadStates, err = newFileUploadStates(uploadStateDir)
+    if err != nil {
+      fatal("failed to set up upload state directory", "error", err)
+    }
+  }
+
+  if err := autoMigrateDatabase(); err != nil {
+    fatal("failed to migrate database", "error", err)
+  }
+
+  if err := loadDefaultEncryption(); err != nil {
+    fatal("invalid encryption settings", "error", err)
+  }
+
+  if err := loadDefaultStorage(); err != nil {
+    fatal("invalid storage settings", "error", err)
+  }
+
+  sinks, err := configuredEventSinks()
   if err != nil {
-    log.Fatal(err)
+    fatal("invalid event sink settings", "error", err)
+  }
+  events = newEventDispatcher(sinks)
+  if db != nil && !events.has("postgres") {
+    logger.Warn("EVENT_SINKS leaves out postgres, the usage API and monthly transfer limits won't see new events")
+  }
+
+  if err := startTracing(); err != nil {
+    fatal("failed to set up tracing", "error", err)
   }
 
   go servePrometheusMetrics()
   go serveProfiling()
-
-  debugStream := ioutil.Discard
-  if debugStderr {
-    debugStream = os.Stderr
+  go janitor.run()
+  go events.run()
+  if db != nil {
+    go runNotifications()
   }
+
   // An SSH server is represented by a ServerConfig, which holds
   // certificate details and handles authentication of ServerConns.
   config := &ssh.ServerConfig{
-    PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-      if len(c.User()) != 20 {
-        return nil, fmt.Errorf("Authentication rejected for %q", c.User())
-      }
-
-      fmt.Fprintf(debugStream, "Login: %s\n", c.User())
-
-      return &ssh.Permissions{Extensions: map[string]string{"ACCESS_KEY_ID": c.User(), "SECRET_KEY_ID": string(pass)}}, nil
-    },
+    PasswordCallback: passwordCallback,
   }
 
   privateBytes, err := ioutil.ReadFile("id_rsa")
   if err != nil {
-    log.Fatal("Failed to load private key", err)
+    fatal("failed to load private key", "error", err)
   }
 
   private, err := ssh.ParsePrivateKey(privateBytes)
   if err != nil {
-    log.Fatal("Failed to parse private key", err)
+    fatal("failed to parse private key", "error", err)
   }
 
   config.AddHostKey(private)
@@ -110,40 +272,139 @@ func main() {
   listener, err := net.Listen("tcp", "0.0.0.0:22")
 
   if err != nil {
-    log.Fatal("failed to listen for connection", err)
+    fatal("failed to listen for connection", "error", err)
   }
 
-  fmt.Printf("Listening on %v\n", listener.Addr())
+  logger.Info("listening", "addr", listener.Addr().String())
+
+  go closeOnSignal(listener)
 
   for {
     nConn, err := listener.Accept()
 
     if err != nil {
-      log.Println("failed to accept incoming connection", err)
+      select {
+      case <-stopping:
+        shutdown()
+        return
+      default:
+      }
+      logger.Error("failed to accept incoming connection", "error", err)
     } else {
-      go handleConnection(nConn, config, debugStream)
+      activeConnections.Add(1)
+      go func() {
+        defer activeConnections.Done()
+        handleConnection(nConn, config)
+      }()
     }
   }
   // Before use, a handshake must be performed on the incoming net.Conn.
 }
 
-func handleConnection(nConn net.Conn, config *ssh.ServerConfig, debugStream io.Writer) {
+var stopping = make(chan struct{})
+var activeConnections sync.WaitGroup
+
+// Stop taking new connections, main then shuts down once the listener is closed
+func closeOnSignal(listener net.Listener) {
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+  <-signals
+
+  logger.Info("shutting down, waiting for sessions to finish", "timeout_seconds", shutdownTimeoutSeconds)
+  close(stopping)
+  listener.Close()
+}
+
+// Give connected sessions a chance to finish their transfers, then flush
+// queued events and traces
+func shutdown() {
+  finished := make(chan struct{})
+  go func() {
+    activeConnections.Wait()
+    close(finished)
+  }()
+
+  select {
+  case <-finished:
+    logger.Info("all sessions finished")
+  case <-time.After(time.Duration(shutdownTimeoutSeconds) * time.Second):
+    logger.Warn("sessions still running at shutdown, closing them", "sessions", len(sessions.list()))
+  }
+
+  events.close()
+  stopTracing()
+}
+
+// Logins need a well formed access key and, when there's a database, a
+// subscription. The secret is passed through for S3 to judge.
+func passwordCallback(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+  if len(c.User()) != 20 {
+    authAttempts.WithLabelValues("invalid_user").Inc()
+    logger.Info("login refused", "remote_addr", c.RemoteAddr().String(), "reason", "invalid_user")
+    return nil, fmt.Errorf("Authentication rejected for %q", c.User())
+  }
+
+  if err := checkSubscription(c.User()); err != nil {
+    authAttempts.WithLabelValues("no_subscription").Inc()
+    logger.Info("login refused", "access_key_id", c.User(), "remote_addr", c.RemoteAddr().String(), "error", err)
+    return nil, fmt.Errorf("Authentication rejected for %q", c.User())
+  }
+
+  authAttempts.WithLabelValues("success").Inc()
+
+  return &ssh.Permissions{Extensions: map[string]string{"ACCESS_KEY_ID": c.User(), "SECRET_KEY_ID": string(pass)}}, nil
+}
+
+func handleConnection(nConn net.Conn, config *ssh.ServerConfig) {
   connectedClients.Inc()
   defer connectedClients.Dec()
 
+  connLog := logger.With("remote_addr", nConn.RemoteAddr().String())
+
+  ctx, connSpan := tracer.Start(context.Background(), "ssh.connection", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+    attribute.String("net.peer.addr", nConn.RemoteAddr().String()),
+  ))
+  defer connSpan.End()
+
+  // Don't let a client that never finishes the handshake hold on to us
+  nConn.SetDeadline(time.Now().Add(time.Duration(handshakeTimeoutSeconds) * time.Second))
+
+  // authentication happens as part of the handshake
+  _, handshakeSpan := tracer.Start(ctx, "ssh.handshake")
   sconn, chans, reqs, err := ssh.NewServerConn(nConn, config)
+  endSpan(handshakeSpan, err)
 
   if err != nil {
-    // log.Println("failed to handshake", err)
+    connLog.Debug("failed to handshake", "error", err)
+    nConn.Close()
     return
   }
+  defer sconn.Close()
+
+  nConn.SetDeadline(time.Time{})
 
   access_key := sconn.Permissions.Extensions["ACCESS_KEY_ID"]
   secret_key := sconn.Permissions.Extensions["SECRET_KEY_ID"]
 
-  log.Println("login detected:", access_key)
+  connLog = connLog.With("access_key_id", access_key)
+  connLog.Info("login detected", "client_version", string(sconn.ClientVersion()))
+  connSpan.SetAttributes(attribute.String("s3tp.access_key_id", access_key))
+
+  userPlan, err := planForUser(access_key)
+  if err != nil {
+    connLog.Error("could not load plan", "error", err)
+    return
+  }
+
+  limitErr := limiter.acquire(access_key, userPlan.maxSessions)
+  if limitErr == nil {
+    defer limiter.release(access_key)
+  }
+
+  watchdog := watchSession(sconn)
+  defer watchdog.stop()
 
-  fmt.Fprintf(debugStream, "SSH server established\n")
+  connLog.Debug("SSH server established")
 
   // The incoming Request channel must be serviced.
   go ssh.DiscardRequests(reqs)
@@ -152,47 +413,81 @@ func handleConnection(nConn net.Conn, config *ssh.ServerConfig, debugStream io.W
     // Channels have a type, depending on the application level
     // protocol intended. In the case of an SFTP session, this is "subsystem"
     // with a payload string of "<length=4>sftp"
-    fmt.Fprintf(debugStream, "Incoming channel: %s\n", newChannel.ChannelType())
+    connLog.Debug("incoming channel", "type", newChannel.ChannelType())
     if newChannel.ChannelType() != "session" {
       newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
-      fmt.Fprintf(debugStream, "Unknown channel type: %s\n", newChannel.ChannelType())
+      connLog.Debug("unknown channel type", "type", newChannel.ChannelType())
+      continue
+    }
+    if limitErr != nil {
+      newChannel.Reject(ssh.ResourceShortage, limitErr.Error())
+      connLog.Warn("connection rejected", "error", limitErr)
+      return
+    }
+    root, err := S3Handler(access_key, secret_key, userPlan)
+    if err != nil {
+      newChannel.Reject(ssh.ConnectionFailed, "could not start session")
+      connLog.Error("could not start session", "error", err)
       continue
     }
     channel, requests, err := newChannel.Accept()
     if err != nil {
-      log.Println("could not accept channel.", err)
+      connLog.Error("could not accept channel", "error", err)
       return
     }
-    fmt.Fprintf(debugStream, "Channel accepted\n")
+    connLog.Debug("channel accepted")
 
     // Sessions have out-of-band requests such as "shell",
     // "pty-req" and "env".  Here we handle only the
     // "subsystem" request.
     go func(in <-chan *ssh.Request) {
       for req := range in {
-        fmt.Fprintf(debugStream, "Request: %v\n", req.Type)
+        connLog.Debug("channel request", "type", req.Type)
         ok := false
         switch req.Type {
         case "subsystem":
-          fmt.Fprintf(debugStream, "Subsystem: %s\n", req.Payload[4:])
+          connLog.Debug("subsystem requested", "subsystem", string(req.Payload[4:]))
           if string(req.Payload[4:]) == "sftp" {
             ok = true
           }
         }
-        fmt.Fprintf(debugStream, " - accepted: %v\n", ok)
+        connLog.Debug("channel request handled", "type", req.Type, "accepted", ok)
         req.Reply(ok, nil)
       }
     }(requests)
 
-    root := S3Handler(access_key, secret_key)
-
-    server := sftp.NewRequestServer(channel, root)
-    if err := server.Serve(); err == io.EOF {
+    started := time.Now()
+    fs := root.FilePut.(*s3fs)
+    fs.set_connection(sconn)
+    sessions.add(fs, watchdog)
+
+    sessionCtx, cancelSession := context.WithCancel(ctx)
+    var sessionSpan trace.Span
+    fs.ctx, sessionSpan = tracer.Start(sessionCtx, "sftp.session", trace.WithAttributes(
+      attribute.String("s3tp.session_id", fs.sessionID.String()),
+      attribute.String("s3tp.access_key_id", access_key),
+    ))
+
+    server := sftp.NewRequestServer(watchdog.track(channel), root)
+    err = server.Serve()
+    if err == io.EOF {
       server.Close()
-      log.Println("sftp client exited session.")
+      fs.log.Info("sftp client exited session")
+      err = nil
     } else if err != nil {
-      log.Println("sftp server completed with error:", err)
+      fs.log.Error("sftp server completed with error", "error", err)
       server.Close()
     }
+
+    // Anything still open was never closed by the client. Writers go first so
+    // parts already in flight can finish and leave the upload resumable, then
+    // the session is cancelled to stop whatever reads are still fetching.
+    fs.abort_open_writers()
+    cancelSession()
+    fs.close_open_readers()
+    sessions.remove(fs)
+
+    fs.persist_event(&event{Category: "SESSION", StartedAt: started}, err)
+    endSpan(sessionSpan, err)
   }
 }
@@ -0,0 +1,269 @@
+package main
+
+import (
+  "container/list"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/hex"
+  "strings"
+  "sync"
+  "time"
+)
+
+var (
+  metadataCacheTTLSeconds int
+  metadataCacheMaxEntries int
+  metadataCacheShared int
+)
+
+func init() {
+  setFromENV("METADATA_CACHE_TTL_SECONDS", &metadataCacheTTLSeconds, 10)
+  setFromENV("METADATA_CACHE_MAX_ENTRIES", &metadataCacheMaxEntries, 10000)
+  setFromENV("METADATA_CACHE_SHARED", &metadataCacheShared, 0)
+
+  if _, err := rand.Read(metadataCacheSecret); err != nil {
+    panic(err)
+  }
+
+  if metadataCacheShared != 0 {
+    sharedMetadataCache = newMetadataCache(time.Duration(metadataCacheTTLSeconds) * time.Second, metadataCacheMaxEntries)
+  }
+}
+
+// Shared by every session when METADATA_CACHE_SHARED is set, entries are
+// keyed by the credentials that fetched them, see metadataCacheScope.
+var sharedMetadataCache *metadataCache
+
+// Random for each process, so cache keys can't be worked out from outside it
+var metadataCacheSecret = make([]byte, 32)
+
+// Logging in doesn't check the secret key, S3 does when it's used. Keying the
+// cache on both means a session with the right access key but the wrong
+// secret never gets a hit, and has to go to S3 like any other.
+func metadataCacheScope(accessKey, secretKey string) (string) {
+  mac := hmac.New(sha256.New, metadataCacheSecret)
+  mac.Write([]byte(accessKey))
+  mac.Write([]byte{0})
+  mac.Write([]byte(secretKey))
+
+  return hex.EncodeToString(mac.Sum(nil))
+}
+
+// A copy of what Stat and List report about an object or directory, cached
+// instead of *s3File because callers go on to open the files they get back.
+type objectMetadata struct {
+  name string
+  isdir bool
+  bucket string
+  key string
+  size int64
+  archived bool
+}
+
+func metadataOf(f *s3File) (objectMetadata) {
+  return objectMetadata{name: f.name, isdir: f.isdir, bucket: f.bucket, key: f.key, size: f.size, archived: f.archived}
+}
+
+func (m objectMetadata) file(fs *s3fs) (*s3File) {
+  return &s3File{name: m.name, isdir: m.isdir, bucket: m.bucket, key: m.key, size: m.size, archived: m.archived, s3fs: fs}
+}
+
+type metadataEntry struct {
+  key string
+  expires time.Time
+  stat *objectMetadata
+  listing map[string]objectMetadata
+}
+
+// A size bounded LRU of Stat and List results that expire after a TTL
+type metadataCache struct {
+  ttl time.Duration
+  maxEntries int
+  entries map[string]*list.Element
+  lru *list.List
+  lock sync.Mutex
+}
+
+func newMetadataCache(ttl time.Duration, maxEntries int) (*metadataCache) {
+  if ttl <= 0 || maxEntries <= 0 {
+    return nil
+  }
+
+  return &metadataCache{
+    ttl: ttl,
+    maxEntries: maxEntries,
+    entries: make(map[string]*list.Element),
+    lru: list.New(),
+  }
+}
+
+func (c *metadataCache) get(key string) (*metadataEntry) {
+  c.lock.Lock()
+  defer c.lock.Unlock()
+
+  element, ok := c.entries[key]
+  if !ok {
+    return nil
+  }
+
+  entry := element.Value.(*metadataEntry)
+  if time.Now().After(entry.expires) {
+    c.lru.Remove(element)
+    delete(c.entries, key)
+    return nil
+  }
+
+  c.lru.MoveToFront(element)
+
+  return entry
+}
+
+func (c *metadataCache) put(entry *metadataEntry) {
+  c.lock.Lock()
+  defer c.lock.Unlock()
+
+  entry.expires = time.Now().Add(c.ttl)
+
+  if element, ok := c.entries[entry.key]; ok {
+    element.Value = entry
+    c.lru.MoveToFront(element)
+    return
+  }
+
+  c.entries[entry.key] = c.lru.PushFront(entry)
+
+  for c.lru.Len() > c.maxEntries {
+    oldest := c.lru.Back()
+    c.lru.Remove(oldest)
+    delete(c.entries, oldest.Value.(*metadataEntry).key)
+    metadataCacheEvictions.Inc()
+  }
+}
+
+func (c *metadataCache) remove(key string) {
+  c.lock.Lock()
+  defer c.lock.Unlock()
+
+  if element, ok := c.entries[key]; ok {
+    c.lru.Remove(element)
+    delete(c.entries, key)
+  }
+}
+
+func (c *metadataCache) len() (int) {
+  c.lock.Lock()
+  defer c.lock.Unlock()
+
+  return c.lru.Len()
+}
+
+func metadataCacheFor() (*metadataCache) {
+  if sharedMetadataCache != nil {
+    return sharedMetadataCache
+  }
+
+  return newMetadataCache(time.Duration(metadataCacheTTLSeconds) * time.Second, metadataCacheMaxEntries)
+}
+
+func (fs *s3fs) stat_cache_key(p string) (string) {
+  return fs.cacheScope + ":stat:" + p
+}
+
+func (fs *s3fs) list_cache_key(p string) (string) {
+  return fs.cacheScope + ":list:" + p
+}
+
+func (fs *s3fs) cached_stat(p string) (*s3File) {
+  if fs.metadata == nil {
+    return nil
+  }
+
+  entry := fs.metadata.get(fs.stat_cache_key(p))
+  if entry == nil || entry.stat == nil {
+    metadataCacheRequests.WithLabelValues("stat", "miss").Inc()
+    return nil
+  }
+
+  metadataCacheRequests.WithLabelValues("stat", "hit").Inc()
+
+  return entry.stat.file(fs)
+}
+
+func (fs *s3fs) cache_stat(p string, f *s3File) {
+  if fs.metadata == nil {
+    return
+  }
+
+  m := metadataOf(f)
+  fs.metadata.put(&metadataEntry{key: fs.stat_cache_key(p), stat: &m})
+}
+
+func (fs *s3fs) cached_listing(p string) (map[string]*s3File) {
+  if fs.metadata == nil {
+    return nil
+  }
+
+  entry := fs.metadata.get(fs.list_cache_key(p))
+  if entry == nil || entry.listing == nil {
+    metadataCacheRequests.WithLabelValues("list", "miss").Inc()
+    return nil
+  }
+
+  metadataCacheRequests.WithLabelValues("list", "hit").Inc()
+
+  files := make(map[string]*s3File, len(entry.listing))
+  for k, m := range entry.listing {
+    files[k] = m.file(fs)
+  }
+
+  return files
+}
+
+// Remember a listing and Stat each thing in it, clients tend to stat what
+// they've just listed.
+func (fs *s3fs) cache_listing(p string, files map[string]*s3File) {
+  if fs.metadata == nil {
+    return
+  }
+
+  listing := make(map[string]objectMetadata, len(files))
+  parent := strings.TrimSuffix(p, delimiter)
+
+  for k, f := range files {
+    m := metadataOf(f)
+    listing[k] = m
+
+    // Stat names things by their full path
+    stat := m
+    stat.name = parent + delimiter + m.name
+    if p == delimiter {
+      stat.bucket = m.name
+    }
+    fs.metadata.put(&metadataEntry{key: fs.stat_cache_key(stat.name), stat: &stat})
+  }
+
+  fs.metadata.put(&metadataEntry{key: fs.list_cache_key(p), listing: listing})
+}
+
+// Forget the path and the listing of every directory above it, a write can
+// create the implicit directories on the way down to it.
+func (fs *s3fs) invalidate_path(p string) {
+  if fs.metadata == nil {
+    return
+  }
+
+  fs.metadata.remove(fs.stat_cache_key(p))
+  fs.metadata.remove(fs.list_cache_key(p))
+
+  for dir := p; dir != delimiter && dir != ""; {
+    i := strings.LastIndex(dir, delimiter)
+    dir = dir[:i]
+    if dir == "" {
+      dir = delimiter
+    }
+
+    fs.metadata.remove(fs.stat_cache_key(dir))
+    fs.metadata.remove(fs.list_cache_key(dir))
+  }
+}
@@ -0,0 +1,14 @@
+CREATE TABLE uploads (
+   id            uuid        NOT NULL DEFAULT uuid_generate_v1()
+  ,access_key_id varchar(20) NOT NULL
+  ,bucket        text        NOT NULL
+  ,object_key    text        NOT NULL
+  ,upload_id     text        NOT NULL
+  ,parts         jsonb       NOT NULL DEFAULT '[]'
+  ,size          bigint      NOT NULL DEFAULT 0
+  ,created_at    timestamptz NOT NULL DEFAULT NOW()
+  ,updated_at    timestamptz NOT NULL DEFAULT NOW()
+  ,PRIMARY KEY (access_key_id, bucket, object_key)
+);
+
+CREATE INDEX uploads_upload_id_idx ON uploads (upload_id);
@@ -0,0 +1,3 @@
+ALTER TABLE plans
+   DROP COLUMN read_bytes_per_second
+  ,DROP COLUMN write_bytes_per_second;
@@ -0,0 +1,3 @@
+ALTER TABLE plans
+   ADD COLUMN read_bytes_per_second  bigint NOT NULL DEFAULT 0
+  ,ADD COLUMN write_bytes_per_second bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,6 @@
+DROP INDEX events_access_key_id_created_at_idx;
+
+ALTER TABLE plans
+   DROP COLUMN monthly_transfer_bytes
+  ,DROP COLUMN max_file_size_bytes
+  ,DROP COLUMN max_sessions;
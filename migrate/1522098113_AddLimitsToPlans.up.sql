@@ -0,0 +1,6 @@
+ALTER TABLE plans
+   ADD COLUMN monthly_transfer_bytes bigint  NOT NULL DEFAULT 0
+  ,ADD COLUMN max_file_size_bytes    bigint  NOT NULL DEFAULT 0
+  ,ADD COLUMN max_sessions           integer NOT NULL DEFAULT 0;
+
+CREATE INDEX events_access_key_id_created_at_idx ON events (access_key_id, created_at);
@@ -0,0 +1,15 @@
+DROP INDEX events_remote_addr_idx;
+DROP INDEX events_bucket_object_key_idx;
+DROP INDEX events_session_id_idx;
+
+ALTER TABLE events
+   DROP COLUMN bucket
+  ,DROP COLUMN object_key
+  ,DROP COLUMN remote_addr
+  ,DROP COLUMN client_version
+  ,DROP COLUMN started_at
+  ,DROP COLUMN ended_at
+  ,DROP COLUMN outcome
+  ,DROP COLUMN error_class
+  ,DROP COLUMN old_path
+  ,DROP COLUMN new_path;
@@ -0,0 +1,15 @@
+ALTER TABLE events
+   ADD COLUMN bucket         text
+  ,ADD COLUMN object_key     text
+  ,ADD COLUMN remote_addr    text
+  ,ADD COLUMN client_version text
+  ,ADD COLUMN started_at     timestamptz
+  ,ADD COLUMN ended_at       timestamptz
+  ,ADD COLUMN outcome        varchar(8)
+  ,ADD COLUMN error_class    text
+  ,ADD COLUMN old_path       text
+  ,ADD COLUMN new_path       text;
+
+CREATE INDEX events_session_id_idx ON events (session_id);
+CREATE INDEX events_bucket_object_key_idx ON events (bucket, object_key);
+CREATE INDEX events_remote_addr_idx ON events (remote_addr);
@@ -0,0 +1,2 @@
+DROP TABLE public.notification_failures;
+DROP TABLE public.notification_endpoints;
@@ -0,0 +1,22 @@
+CREATE TABLE notification_endpoints (
+   id            uuid        NOT NULL DEFAULT uuid_generate_v1()
+  ,access_key_id varchar(20) NOT NULL
+  ,url           text        NOT NULL
+  ,secret        text        NOT NULL DEFAULT ''
+  ,active        boolean     NOT NULL DEFAULT TRUE
+  ,created_at    timestamptz NOT NULL DEFAULT NOW()
+  ,updated_at    timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX notification_endpoints_access_key_id_idx ON notification_endpoints (access_key_id);
+
+CREATE TABLE notification_failures (
+   id            uuid        NOT NULL DEFAULT uuid_generate_v1()
+  ,access_key_id varchar(20) NOT NULL
+  ,url           text        NOT NULL
+  ,payload       jsonb       NOT NULL
+  ,error         text        NOT NULL
+  ,attempts      integer     NOT NULL DEFAULT 0
+  ,created_at    timestamptz NOT NULL DEFAULT NOW()
+  ,updated_at    timestamptz NOT NULL DEFAULT NOW()
+);
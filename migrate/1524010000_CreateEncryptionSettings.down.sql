@@ -0,0 +1 @@
+DROP TABLE public.encryption_settings;
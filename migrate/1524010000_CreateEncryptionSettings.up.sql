@@ -0,0 +1,14 @@
+CREATE TABLE encryption_settings (
+   id            uuid        NOT NULL DEFAULT uuid_generate_v1()
+  ,access_key_id varchar(20) NOT NULL
+  ,bucket        text        NOT NULL DEFAULT ''
+  ,mode          varchar(8)  NOT NULL
+  ,kms_key_id    text        NOT NULL DEFAULT ''
+  ,kms_context   jsonb
+  ,customer_key  text        NOT NULL DEFAULT ''
+  ,created_at    timestamptz NOT NULL DEFAULT NOW()
+  ,updated_at    timestamptz NOT NULL DEFAULT NOW()
+  ,CONSTRAINT encryption_settings_mode_check CHECK (mode IN ('sse-s3', 'sse-kms', 'sse-c'))
+);
+
+CREATE UNIQUE INDEX encryption_settings_access_key_id_bucket_idx ON encryption_settings (access_key_id, bucket);
@@ -0,0 +1,6 @@
+DELETE FROM encryption_settings WHERE mode = 'none';
+
+ALTER TABLE encryption_settings DROP CONSTRAINT encryption_settings_mode_check;
+ALTER TABLE encryption_settings ADD CONSTRAINT encryption_settings_mode_check CHECK (mode IN ('sse-s3', 'sse-kms', 'sse-c'));
+
+ALTER TABLE encryption_settings DROP COLUMN client_side;
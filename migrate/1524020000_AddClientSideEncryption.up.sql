@@ -0,0 +1,4 @@
+ALTER TABLE encryption_settings ADD COLUMN client_side boolean NOT NULL DEFAULT false;
+
+ALTER TABLE encryption_settings DROP CONSTRAINT encryption_settings_mode_check;
+ALTER TABLE encryption_settings ADD CONSTRAINT encryption_settings_mode_check CHECK (mode IN ('none', 'sse-s3', 'sse-kms', 'sse-c'));
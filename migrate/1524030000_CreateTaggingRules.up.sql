@@ -0,0 +1,11 @@
+CREATE TABLE tagging_rules (
+   id            uuid        NOT NULL DEFAULT uuid_generate_v1()
+  ,access_key_id varchar(20) NOT NULL
+  ,bucket        text        NOT NULL DEFAULT ''
+  ,prefix        text        NOT NULL DEFAULT ''
+  ,tags          jsonb       NOT NULL
+  ,created_at    timestamptz NOT NULL DEFAULT NOW()
+  ,updated_at    timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX tagging_rules_access_key_id_idx ON tagging_rules (access_key_id);
@@ -0,0 +1,13 @@
+CREATE TABLE storage_settings (
+   id              uuid        NOT NULL DEFAULT uuid_generate_v1()
+  ,access_key_id   varchar(20) NOT NULL
+  ,bucket          text        NOT NULL DEFAULT ''
+  ,storage_class   text        NOT NULL DEFAULT ''
+  ,restore_on_read boolean     NOT NULL DEFAULT FALSE
+  ,restore_days    integer     NOT NULL DEFAULT 1
+  ,restore_tier    text        NOT NULL DEFAULT 'Standard'
+  ,created_at      timestamptz NOT NULL DEFAULT NOW()
+  ,updated_at      timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX storage_settings_access_key_id_bucket_idx ON storage_settings (access_key_id, bucket);
@@ -0,0 +1,14 @@
+CREATE TABLE pending_notifications (
+   id              uuid        NOT NULL DEFAULT uuid_generate_v1()
+  ,access_key_id   varchar(20) NOT NULL
+  ,url             text        NOT NULL
+  ,secret          text        NOT NULL DEFAULT ''
+  ,payload         jsonb       NOT NULL
+  ,attempts        integer     NOT NULL DEFAULT 0
+  ,last_error      text        NOT NULL DEFAULT ''
+  ,next_attempt_at timestamptz NOT NULL DEFAULT NOW()
+  ,created_at      timestamptz NOT NULL DEFAULT NOW()
+  ,updated_at      timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX pending_notifications_next_attempt_at_idx ON pending_notifications (next_attempt_at);
@@ -0,0 +1,311 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "embed"
+  "errors"
+  "fmt"
+  "os"
+  "path"
+  "regexp"
+  "sort"
+  "strconv"
+)
+
+//go:embed migrate/*.sql
+var migrationFiles embed.FS
+
+var autoMigrate int
+
+func init() {
+  setFromENV("AUTO_MIGRATE", &autoMigrate, 0)
+}
+
+// Held while migrating so that instances starting together don't race
+const migrationLockID = 51737470
+
+var migrationFilename = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+type migration struct {
+  version int64
+  name string
+  up string
+  down string
+}
+
+// The embedded migrations in version order
+func loadMigrations() ([]*migration, error) {
+  entries, err := migrationFiles.ReadDir("migrate")
+  if err != nil {
+    return nil, err
+  }
+
+  byVersion := make(map[int64]*migration)
+
+  for _, entry := range entries {
+    match := migrationFilename.FindStringSubmatch(entry.Name())
+    if match == nil {
+      continue
+    }
+
+    version, err := strconv.ParseInt(match[1], 10, 64)
+    if err != nil {
+      return nil, err
+    }
+
+    contents, err := migrationFiles.ReadFile(path.Join("migrate", entry.Name()))
+    if err != nil {
+      return nil, err
+    }
+
+    m, ok := byVersion[version]
+    if !ok {
+      m = &migration{version: version, name: match[2]}
+      byVersion[version] = m
+    }
+
+    if match[3] == "up" {
+      m.up = string(contents)
+    } else {
+      m.down = string(contents)
+    }
+  }
+
+  migrations := make([]*migration, 0, len(byVersion))
+  for _, m := range byVersion {
+    migrations = append(migrations, m)
+  }
+
+  sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+
+  return migrations, nil
+}
+
+// `s3tp migrate up|down [n]|status`, returns the exit code
+func runMigrateCommand(args []string) (int) {
+  if len(args) == 0 {
+    fmt.Fprintln(os.Stderr, "usage: s3tp migrate up|down [n]|status")
+    return 2
+  }
+
+  if DatabaseURL == "" {
+    fmt.Fprintln(os.Stderr, "DATABASE_URL is not set")
+    return 1
+  }
+
+  var err error
+
+  db, err = sql.Open("postgres", DatabaseURL)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return 1
+  }
+  defer db.Close()
+
+  switch args[0] {
+  case "up":
+    err = withMigrationLock(migrateUp)
+  case "down":
+    steps := 1
+    if len(args) > 1 {
+      if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+        fmt.Fprintln(os.Stderr, "down takes a positive number of migrations to roll back")
+        return 2
+      }
+    }
+    err = withMigrationLock(func(conn *sql.Conn) error { return migrateDown(conn, steps) })
+  case "status":
+    err = withMigrationLock(migrationStatus)
+  default:
+    fmt.Fprintf(os.Stderr, "unknown migrate command %q\n", args[0])
+    return 2
+  }
+
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return 1
+  }
+
+  return 0
+}
+
+// Run fn on a single connection holding the migration advisory lock
+func withMigrationLock(fn func(conn *sql.Conn) error) (error) {
+  ctx := context.Background()
+
+  conn, err := db.Conn(ctx)
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+
+  if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1);`, migrationLockID); err != nil {
+    return err
+  }
+  defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1);`, migrationLockID)
+
+  // Shares its layout with mattes/migrate so databases it set up carry on
+  // from where they are
+  var query = `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+       version bigint  NOT NULL PRIMARY KEY
+      ,dirty   boolean NOT NULL
+    );
+  `
+  if _, err := conn.ExecContext(ctx, query); err != nil {
+    return err
+  }
+
+  return fn(conn)
+}
+
+// The version the database is at, 0 before any migrations
+func currentMigrationVersion(conn *sql.Conn) (int64, error) {
+  var version int64
+  var dirty bool
+
+  err := conn.QueryRowContext(context.Background(), `SELECT version, dirty FROM schema_migrations LIMIT 1;`).Scan(&version, &dirty)
+  if err == sql.ErrNoRows {
+    return 0, nil
+  }
+  if err != nil {
+    return 0, err
+  }
+
+  if dirty {
+    return version, fmt.Errorf("database is dirty at version %d, fix it by hand and reset schema_migrations", version)
+  }
+
+  return version, nil
+}
+
+// Apply the migration's SQL and record the new version in one transaction
+func applyMigration(conn *sql.Conn, statements string, version int64) (error) {
+  ctx := context.Background()
+
+  txn, err := conn.BeginTx(ctx, nil)
+  if err != nil {
+    return err
+  }
+
+  if _, err := txn.ExecContext(ctx, statements); err != nil {
+    txn.Rollback()
+    return err
+  }
+
+  if _, err := txn.ExecContext(ctx, `DELETE FROM schema_migrations;`); err != nil {
+    txn.Rollback()
+    return err
+  }
+
+  if version > 0 {
+    if _, err := txn.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false);`, version); err != nil {
+      txn.Rollback()
+      return err
+    }
+  }
+
+  return txn.Commit()
+}
+
+func migrateUp(conn *sql.Conn) (error) {
+  migrations, err := loadMigrations()
+  if err != nil {
+    return err
+  }
+
+  current, err := currentMigrationVersion(conn)
+  if err != nil {
+    return err
+  }
+
+  for _, m := range migrations {
+    if m.version <= current {
+      continue
+    }
+
+    if err := applyMigration(conn, m.up, m.version); err != nil {
+      return fmt.Errorf("migration %d_%s failed: %v", m.version, m.name, err)
+    }
+
+    logger.Info("migrated up", "version", m.version, "name", m.name)
+  }
+
+  return nil
+}
+
+func migrateDown(conn *sql.Conn, steps int) (error) {
+  migrations, err := loadMigrations()
+  if err != nil {
+    return err
+  }
+
+  current, err := currentMigrationVersion(conn)
+  if err != nil {
+    return err
+  }
+
+  for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+    m := migrations[i]
+    if m.version > current {
+      continue
+    }
+
+    if m.down == "" {
+      return fmt.Errorf("migration %d_%s has no down migration", m.version, m.name)
+    }
+
+    var previous int64
+    if i > 0 {
+      previous = migrations[i - 1].version
+    }
+
+    if err := applyMigration(conn, m.down, previous); err != nil {
+      return fmt.Errorf("migration %d_%s failed: %v", m.version, m.name, err)
+    }
+
+    logger.Info("migrated down", "version", m.version, "name", m.name)
+    steps--
+  }
+
+  return nil
+}
+
+func migrationStatus(conn *sql.Conn) (error) {
+  migrations, err := loadMigrations()
+  if err != nil {
+    return err
+  }
+
+  current, err := currentMigrationVersion(conn)
+  if err != nil {
+    return err
+  }
+
+  for _, m := range migrations {
+    state := "pending"
+    if m.version <= current {
+      state = "applied"
+    }
+
+    fmt.Printf("%-8s %d_%s\n", state, m.version, m.name)
+  }
+
+  return nil
+}
+
+var errMigrationsWithoutDatabase = errors.New("AUTO_MIGRATE is set but DATABASE_URL is not")
+
+// Bring the database up to date at startup when AUTO_MIGRATE is set
+func autoMigrateDatabase() (error) {
+  if autoMigrate == 0 {
+    return nil
+  }
+
+  if db == nil {
+    return errMigrationsWithoutDatabase
+  }
+
+  return withMigrationLock(migrateUp)
+}
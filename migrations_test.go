@@ -0,0 +1,25 @@
+package main
+
+import (
+  "testing"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+  migrations, err := loadMigrations()
+  assert.Nil(t, err)
+  assert.NotEmpty(t, migrations)
+
+  assert.Equal(t, int64(1517442400), migrations[0].version)
+  assert.Equal(t, "events", migrations[0].name)
+
+  for i, m := range migrations {
+    assert.NotEmpty(t, m.up, m.name)
+    assert.NotEmpty(t, m.down, m.name)
+
+    if i > 0 {
+      assert.True(t, migrations[i - 1].version < m.version)
+    }
+  }
+}
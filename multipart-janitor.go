@@ -0,0 +1,170 @@
+package main
+
+import (
+  "path"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/service/s3"
+)
+
+var (
+  multipartMaxAgeHours int
+  multipartJanitorIntervalMinutes int
+)
+
+func init() {
+  setFromENV("MULTIPART_MAX_AGE_HOURS", &multipartMaxAgeHours, 24)
+  setFromENV("MULTIPART_JANITOR_INTERVAL_MINUTES", &multipartJanitorIntervalMinutes, 60)
+}
+
+// A prefix that s3tp has written to along with the credentials that were
+// used, the server has no credentials of its own to clean up with.
+type janitorTarget struct {
+  accessKey string
+  secretKey string
+  bucket string
+  prefix string
+  lastWrite time.Time
+}
+
+// The janitor periodically aborts the multipart uploads s3tp recorded in
+// upload state that are older than MULTIPART_MAX_AGE_HOURS, under every
+// prefix written to since the process started. It catches the uploads that
+// abort_open_writers couldn't and resumable uploads nobody came back for.
+// Uploads other users or tools started under the same prefix are left alone.
+// The server has no credentials of its own, so uploads left by a process that
+// died are only swept once their user connects again, see adopt.
+type multipartJanitor struct {
+  targets map[string]*janitorTarget
+  targetsLock sync.Mutex
+  newClient func(accessKey, secretKey string) (*s3.S3)
+}
+
+var janitor = &multipartJanitor{targets: make(map[string]*janitorTarget), newClient: s3Client}
+
+func (j *multipartJanitor) remember(accessKey, secretKey, bucket, key string) {
+  prefix := path.Dir(key) + delimiter
+  if prefix == "." + delimiter {
+    prefix = ""
+  }
+
+  j.targetsLock.Lock()
+  defer j.targetsLock.Unlock()
+
+  id := accessKey + delimiter + bucket + delimiter + prefix
+
+  j.targets[id] = &janitorTarget{
+    accessKey: accessKey,
+    secretKey: secretKey,
+    bucket: bucket,
+    prefix: prefix,
+    lastWrite: time.Now(),
+  }
+}
+
+// Look after the uploads recorded for a user that has just connected,
+// including any an earlier process never finished
+func (j *multipartJanitor) adopt(accessKey, secretKey string) {
+  states, err := uploadStates.list(accessKey)
+  if err != nil {
+    logger.Error("janitor could not load upload state", "access_key_id", accessKey, "error", err)
+    return
+  }
+
+  for _, u := range states {
+    j.remember(accessKey, secretKey, u.bucket, u.key)
+  }
+}
+
+func (j *multipartJanitor) run() {
+  interval := time.Duration(multipartJanitorIntervalMinutes) * time.Minute
+
+  for range time.Tick(interval) {
+    j.sweep()
+  }
+}
+
+func (j *multipartJanitor) sweep() {
+  maxAge := time.Duration(multipartMaxAgeHours) * time.Hour
+  cutoff := time.Now().Add(-maxAge)
+
+  j.targetsLock.Lock()
+  targets := make(map[string]janitorTarget, len(j.targets))
+  for id, t := range j.targets {
+    targets[id] = *t
+  }
+  j.targetsLock.Unlock()
+
+  for id, t := range targets {
+    states, err := uploadStates.list(t.accessKey)
+    if err != nil {
+      logger.Error("janitor could not load upload state", "access_key_id", t.accessKey, "error", err)
+      continue
+    }
+
+    ours := make(map[string]bool)
+    for _, u := range states {
+      if u.bucket == t.bucket && strings.HasPrefix(u.key, t.prefix) {
+        ours[u.uploadID] = true
+      }
+    }
+
+    client := j.newClient(t.accessKey, t.secretKey)
+
+    err = client.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+      Bucket: aws.String(t.bucket),
+      Prefix: aws.String(t.prefix),
+    }, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+      for _, u := range page.Uploads {
+        if !ours[aws.StringValue(u.UploadId)] || u.Initiated == nil || u.Initiated.After(cutoff) {
+          continue
+        }
+
+        err := abortMultipartUpload(client, t.bucket, *u.Key, *u.UploadId)
+        if err == nil {
+          err = deleteUploadState(t.accessKey, t.bucket, *u.Key, *u.UploadId)
+        }
+        if err != nil {
+          logger.Error("janitor could not abort upload", "bucket", t.bucket, "key", *u.Key, "error", err)
+        } else {
+          logger.Info("janitor aborted stale upload", "bucket", t.bucket, "key", *u.Key)
+        }
+      }
+      return true
+    })
+
+    if err != nil {
+      logger.Error("janitor could not list uploads", "bucket", t.bucket, "prefix", t.prefix, "error", err)
+      continue
+    }
+
+    // Anything we started under this prefix is now older than the cutoff and
+    // has been swept, there's nothing left for us to look after.
+    if t.lastWrite.Before(cutoff) {
+      j.forget(id, t.lastWrite)
+    }
+  }
+}
+
+func (j *multipartJanitor) forget(id string, lastWrite time.Time) {
+  j.targetsLock.Lock()
+  defer j.targetsLock.Unlock()
+
+  // Don't forget a prefix that was written to again while we were sweeping
+  if t, ok := j.targets[id]; ok && !t.lastWrite.After(lastWrite) {
+    delete(j.targets, id)
+  }
+}
+
+func abortMultipartUpload(client *s3.S3, bucket, key, uploadID string) (error) {
+  _, err := client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+    Bucket: aws.String(bucket),
+    Key: aws.String(key),
+    UploadId: aws.String(uploadID),
+  })
+
+  return err
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "sync"
+
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/service/s3"
+  "go.opentelemetry.io/otel/attribute"
+  "go.opentelemetry.io/otel/trace"
+)
+
+// S3's multipart limits
+const (
+  maxPartCount = 10000
+  minPartSize = 5 * mb
+  maxPartSize = 5 * gb
+  maxObjectSize = 5 * tb
+  maxCopySize = 5 * gb
+)
+
+// Files no bigger than this are uploaded with a single PutObject when they're
+// closed instead of as a multipart upload
+var smallFileThresholdMB int
+var smallFileThresholdBytes int64
+
+// Every part is held in memory until S3 has it, so parts are kept well below
+// S3's 5 GB maximum and all uploads together share uploadMemoryMB.
+var (
+  maxPartSizeMB int
+  maxPartSizeBytes int64
+  uploadMemoryMB int
+)
+
+func init() {
+  setFromENV("SMALL_FILE_THRESHOLD_MB", &smallFileThresholdMB, 5)
+  smallFileThresholdBytes = int64(smallFileThresholdMB) * mb
+
+  setFromENV("MAX_PART_SIZE_MB", &maxPartSizeMB, 1024)
+  setFromENV("UPLOAD_MEMORY_MB", &uploadMemoryMB, 4096)
+
+  maxPartSizeBytes = int64(maxPartSizeMB) * mb
+  if maxPartSizeBytes > maxPartSize {
+    maxPartSizeBytes = maxPartSize
+  }
+  if maxPartSizeBytes < minPartSize {
+    maxPartSizeBytes = minPartSize
+  }
+
+  uploadBuffers = newMemoryBudget(int64(uploadMemoryMB) * mb)
+  // a part has to fit in the budget or it could never be sent
+  if maxPartSizeBytes > uploadBuffers.limit {
+    maxPartSizeBytes = uploadBuffers.limit / mb * mb
+  }
+  if maxPartSizeBytes < minPartSize {
+    maxPartSizeBytes = minPartSize
+    uploadBuffers.limit = minPartSize
+  }
+}
+
+// Part sizes double every partsPerSize parts so that starting from the 5 MB
+// minimum and stopping at the default 1 GB maxPartSizeBytes an upload still
+// reaches 5 TB within maxPartCount parts.
+const partsPerSize = 600
+
+// Memory set aside for upload buffers across all sessions. A writer reserves
+// a whole part before it starts buffering one and the reservation is given
+// back once S3 has the part, so writers wait rather than run the server out
+// of memory.
+var uploadBuffers *memoryBudget
+
+type memoryBudget struct {
+  lock sync.Mutex
+  used int64
+  limit int64
+  freed chan struct{} // closed and replaced whenever memory is released
+}
+
+func newMemoryBudget(limit int64) (*memoryBudget) {
+  return &memoryBudget{limit: limit, freed: make(chan struct{})}
+}
+
+func (b *memoryBudget) acquire(ctx context.Context, n int64) (error) {
+  for {
+    b.lock.Lock()
+    if b.used == 0 || b.used + n <= b.limit {
+      b.used += n
+      b.lock.Unlock()
+      uploadBufferBytes.Add(float64(n))
+      return nil
+    }
+    freed := b.freed
+    b.lock.Unlock()
+
+    select {
+    case <-freed:
+    case <-ctx.Done():
+      return ctx.Err()
+    }
+  }
+}
+
+func (b *memoryBudget) release(n int64) {
+  if n == 0 {
+    return
+  }
+
+  b.lock.Lock()
+  b.used -= n
+  close(b.freed)
+  b.freed = make(chan struct{})
+  b.lock.Unlock()
+
+  uploadBufferBytes.Sub(float64(n))
+}
+
+// The part size to start an upload with. When the client told us how big the
+// file is, start big enough to fit it in maxPartCount parts.
+func basePartSize(declaredSize int64) (int64) {
+  size := initialPartSizeBytes
+  if size < minPartSize {
+    size = minPartSize
+  }
+
+  if declaredSize > 0 {
+    needed := (declaredSize + maxPartCount - 1) / maxPartCount
+    needed = (needed + mb - 1) / mb * mb
+    if needed > size {
+      size = needed
+    }
+  }
+
+  if size > maxPartSizeBytes {
+    size = maxPartSizeBytes
+  }
+
+  return size
+}
+
+// Streams data into an S3 multipart upload. Unlike the s3gof3r PutWriter we
+// used to use we hold on to the UploadId and the completed parts so that an
+// upload can be picked up again by a later session. The multipart upload is
+// only started once more than smallFileThresholdBytes have been written,
+// smaller files are sent in one PutObject.
+type multipartWriter struct {
+  // the upload's span, the parts are traced under it
+  ctx context.Context
+  client *s3.S3
+  bucket string
+  key string
+  uploadID string // empty until the multipart upload is started
+  partSize int64 // of the first part, later parts grow, see partSizeFor
+  buffer []byte
+  reserved int64 // of uploadBuffers, held for the part being buffered
+  nextPartNumber int64
+  encryption *encryptionSettings // nil leaves it to the bucket
+  metadata map[string]*string
+  contentType *string
+  tagging *string
+  storageClass *string
+  sealer *chunkSealer // set when encrypting client-side
+
+  // parts that finished uploading, keyed by part number
+  uploadedParts map[int64]*s3.CompletedPart
+  uploadedSizes map[int64]int64
+
+  // the run of parts from 1 with no gaps, this is what can be resumed
+  committedParts []*s3.CompletedPart
+  committedBytes int64
+  onCommit func(parts []*s3.CompletedPart, size int64)
+  onStart func() // once the multipart upload has an UploadId
+
+  // set once the upload is complete
+  etag string
+
+  err error
+  lock sync.Mutex
+  inflight sync.WaitGroup
+  slots chan struct{}
+}
+
+func newMultipartWriter(ctx context.Context, client *s3.S3, bucket, key string) (*multipartWriter) {
+  return resumeMultipartWriter(ctx, client, bucket, key, "", nil, 0)
+}
+
+// Continue an upload from the parts a previous writer committed
+func resumeMultipartWriter(ctx context.Context, client *s3.S3, bucket, key, uploadID string, parts []*s3.CompletedPart, size int64) (*multipartWriter) {
+  slotCount := concurrency
+  if slotCount < 1 {
+    slotCount = 1
+  }
+
+  return &multipartWriter{
+    ctx: ctx,
+    client: client,
+    bucket: bucket,
+    key: key,
+    uploadID: uploadID,
+    partSize: basePartSize(0),
+    nextPartNumber: int64(len(parts)) + 1,
+    uploadedParts: make(map[int64]*s3.CompletedPart),
+    uploadedSizes: make(map[int64]int64),
+    committedParts: parts,
+    committedBytes: size,
+    slots: make(chan struct{}, slotCount),
+  }
+}
+
+func (w *multipartWriter) Write(data []byte) (int, error) {
+  if err := w.error(); err != nil {
+    return 0, err
+  }
+
+  if w.sealer != nil {
+    if err := w.write(w.sealer.write(data)); err != nil {
+      return 0, err
+    }
+    return len(data), nil
+  }
+
+  if err := w.write(data); err != nil {
+    return 0, err
+  }
+
+  return len(data), nil
+}
+
+func (w *multipartWriter) write(data []byte) (error) {
+  if err := w.reserve(); err != nil {
+    return err
+  }
+  w.buffer = append(w.buffer, data...)
+
+  if w.uploadID == "" {
+    if int64(len(w.buffer)) <= smallFileThresholdBytes {
+      return nil
+    }
+
+    if err := w.start(); err != nil {
+      return err
+    }
+  }
+
+  for size := w.partSizeFor(w.nextPartNumber); int64(len(w.buffer)) >= size; size = w.partSizeFor(w.nextPartNumber) {
+    // the part keeps the buffer's memory, only what's left over is copied
+    part := w.buffer[:size:size]
+    w.buffer = append([]byte(nil), w.buffer[size:]...)
+
+    reserved := w.reserved
+    w.reserved = 0
+    w.uploadPart(part, reserved)
+  }
+
+  return nil
+}
+
+// Set aside memory for the next part before buffering it. A writer only ever
+// waits while it holds nothing, so writers can't hold each other up forever.
+func (w *multipartWriter) reserve() (error) {
+  if w.reserved > 0 {
+    return nil
+  }
+
+  size := w.partSizeFor(w.nextPartNumber)
+  if w.uploadID == "" && smallFileThresholdBytes >= size {
+    size = smallFileThresholdBytes + 1
+  }
+
+  if err := uploadBuffers.acquire(w.ctx, size); err != nil {
+    w.lock.Lock()
+    if w.err == nil {
+      w.err = err
+    }
+    w.lock.Unlock()
+    return err
+  }
+  w.reserved = size
+
+  buffer := make([]byte, len(w.buffer), size)
+  copy(buffer, w.buffer)
+  w.buffer = buffer
+
+  return nil
+}
+
+// Drop whatever is still buffered and give its memory back
+func (w *multipartWriter) releaseBuffer() {
+  w.buffer = nil
+  uploadBuffers.release(w.reserved)
+  w.reserved = 0
+}
+
+func (w *multipartWriter) start() (error) {
+  input := &s3.CreateMultipartUploadInput{
+    Bucket: aws.String(w.bucket),
+    Key: aws.String(w.key),
+    Metadata: w.metadata,
+    ContentType: w.contentType,
+    Tagging: w.tagging,
+    StorageClass: w.storageClass,
+  }
+  w.encryption.applyToCreate(input)
+
+  output, err := w.client.CreateMultipartUploadWithContext(w.ctx, input, w.encryption.requestOptions()...)
+
+  if err != nil {
+    w.lock.Lock()
+    w.err = err
+    w.lock.Unlock()
+    return err
+  }
+
+  w.uploadID = aws.StringValue(output.UploadId)
+  if w.onStart != nil {
+    w.onStart()
+  }
+
+  return nil
+}
+
+func (w *multipartWriter) partSizeFor(number int64) (int64) {
+  size := w.partSize << uint((number - 1) / partsPerSize)
+  if size > maxPartSizeBytes || size <= 0 {
+    size = maxPartSizeBytes
+  }
+
+  return size
+}
+
+// Send a part in the background, reserved is the memory it holds and is
+// given back once it's sent
+func (w *multipartWriter) uploadPart(data []byte, reserved int64) {
+  number := w.nextPartNumber
+  w.nextPartNumber++
+
+  if number > maxPartCount {
+    uploadBuffers.release(reserved)
+    w.lock.Lock()
+    if w.err == nil {
+      w.err = errMaxFileSizeExceeded
+    }
+    w.lock.Unlock()
+    return
+  }
+
+  // includes the time spent waiting for a free upload slot
+  ctx, span := tracer.Start(w.ctx, "multipart.part", trace.WithAttributes(
+    attribute.Int64("s3.part_number", number),
+    attribute.Int("s3.part_size", len(data)),
+  ))
+
+  w.slots <- struct{}{}
+  w.inflight.Add(1)
+
+  go func() {
+    defer w.inflight.Done()
+    defer func() { <-w.slots }()
+    defer uploadBuffers.release(reserved)
+
+    input := &s3.UploadPartInput{
+      Body: bytes.NewReader(data),
+      Bucket: aws.String(w.bucket),
+      Key: aws.String(w.key),
+      UploadId: aws.String(w.uploadID),
+      PartNumber: aws.Int64(number),
+      ContentLength: aws.Int64(int64(len(data))),
+    }
+    w.encryption.applyToPart(input)
+
+    output, err := w.client.UploadPartWithContext(ctx, input)
+    endSpan(span, err)
+
+    w.lock.Lock()
+    defer w.lock.Unlock()
+
+    if err != nil {
+      if w.err == nil {
+        w.err = err
+      }
+      return
+    }
+
+    w.uploadedParts[number] = &s3.CompletedPart{ETag: output.ETag, PartNumber: aws.Int64(number)}
+    w.uploadedSizes[number] = int64(len(data))
+    w.commit()
+  }()
+}
+
+// Move every part that now follows on from the committed run into it. Must be
+// called with the lock held.
+func (w *multipartWriter) commit() {
+  advanced := false
+
+  for {
+    next := int64(len(w.committedParts)) + 1
+    part, ok := w.uploadedParts[next]
+    if !ok {
+      break
+    }
+
+    w.committedParts = append(w.committedParts, part)
+    w.committedBytes += w.uploadedSizes[next]
+    delete(w.uploadedParts, next)
+    delete(w.uploadedSizes, next)
+    advanced = true
+  }
+
+  if advanced && w.onCommit != nil {
+    parts := make([]*s3.CompletedPart, len(w.committedParts))
+    copy(parts, w.committedParts)
+    w.onCommit(parts, w.committedBytes)
+  }
+}
+
+func (w *multipartWriter) error() (error) {
+  w.lock.Lock()
+  defer w.lock.Unlock()
+
+  return w.err
+}
+
+// Bytes that have made it to S3 in the committed run of parts
+func (w *multipartWriter) Committed() (int64) {
+  w.lock.Lock()
+  defer w.lock.Unlock()
+
+  return w.committedBytes
+}
+
+func (w *multipartWriter) Close() (error) {
+  if w.sealer != nil {
+    if err := w.write(w.sealer.close()); err != nil {
+      w.Abort()
+      return err
+    }
+  }
+
+  if w.uploadID == "" {
+    return w.putObject()
+  }
+
+  if len(w.buffer) > 0 || w.nextPartNumber == 1 {
+    w.uploadPart(w.buffer, w.reserved)
+    w.buffer = nil
+    w.reserved = 0
+  }
+  w.releaseBuffer()
+
+  w.inflight.Wait()
+
+  if err := w.error(); err != nil {
+    w.Abort()
+    return err
+  }
+
+  parts := w.committedParts
+
+  output, err := w.client.CompleteMultipartUploadWithContext(w.ctx, &s3.CompleteMultipartUploadInput{
+    Bucket: aws.String(w.bucket),
+    Key: aws.String(w.key),
+    UploadId: aws.String(w.uploadID),
+    MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+  })
+
+  if err != nil {
+    w.Abort()
+    return err
+  }
+
+  w.etag = aws.StringValue(output.ETag)
+
+  return nil
+}
+
+// Everything was buffered, send it in one go
+func (w *multipartWriter) putObject() (error) {
+  defer w.releaseBuffer()
+
+  if err := w.error(); err != nil {
+    return err
+  }
+
+  input := &s3.PutObjectInput{
+    Body: bytes.NewReader(w.buffer),
+    Bucket: aws.String(w.bucket),
+    Key: aws.String(w.key),
+    ContentLength: aws.Int64(int64(len(w.buffer))),
+    Metadata: w.metadata,
+    ContentType: w.contentType,
+    Tagging: w.tagging,
+    StorageClass: w.storageClass,
+  }
+  w.encryption.applyToPut(input)
+
+  output, err := w.client.PutObjectWithContext(w.ctx, input, w.encryption.requestOptions()...)
+
+  if err != nil {
+    return err
+  }
+
+  w.etag = aws.StringValue(output.ETag)
+
+  return nil
+}
+
+// Wait for any parts in flight and leave the upload open in S3 so a later
+// session can resume it.
+func (w *multipartWriter) Suspend() {
+  w.inflight.Wait()
+  w.releaseBuffer()
+}
+
+func (w *multipartWriter) Abort() (error) {
+  w.inflight.Wait()
+  w.releaseBuffer()
+
+  if w.uploadID == "" {
+    return nil
+  }
+
+  return abortMultipartUpload(w.client, w.bucket, w.key, w.uploadID)
+}
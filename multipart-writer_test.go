@@ -0,0 +1,79 @@
+package main
+
+import (
+  "context"
+  "testing"
+  "time"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func TestPartSizesReachTheLargestObject(t *testing.T) {
+  w := &multipartWriter{partSize: basePartSize(0)}
+  assert.Equal(t, minPartSize, w.partSizeFor(1))
+
+  var total int64
+  for number := int64(1); number <= maxPartCount; number++ {
+    size := w.partSizeFor(number)
+    assert.True(t, size <= maxPartSizeBytes)
+    total += size
+  }
+
+  assert.True(t, total >= maxObjectSize)
+}
+
+func TestBasePartSizeFitsTheDeclaredSize(t *testing.T) {
+  assert.Equal(t, minPartSize, basePartSize(200))
+  assert.Equal(t, minPartSize, basePartSize(40 * gb))
+
+  size := basePartSize(500 * gb)
+  assert.True(t, size * maxPartCount >= 500 * gb)
+  assert.Equal(t, int64(0), size % mb)
+
+  assert.Equal(t, maxPartSizeBytes, basePartSize(100 * tb))
+}
+
+func TestDeclaredSize(t *testing.T) {
+  assert.Equal(t, int64(0), declaredSize(nil))
+  assert.Equal(t, int64(0), declaredSize([]byte{0, 0, 0, 4, 0, 0, 0, 0}))
+  assert.Equal(t, int64(1 << 33), declaredSize([]byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 0}))
+}
+
+func TestSmallFilesWaitForClose(t *testing.T) {
+  w := newMultipartWriter(context.Background(), nil, "s3tp-test", "hello")
+
+  n, err := w.Write([]byte("ISA*00*          *00*"))
+  assert.Nil(t, err)
+  assert.Equal(t, 21, n)
+  assert.Equal(t, "", w.uploadID)
+  assert.Equal(t, int64(1), w.nextPartNumber)
+
+  // nothing to abort in S3 yet
+  assert.Nil(t, w.Abort())
+  assert.Equal(t, int64(0), uploadBuffers.used)
+}
+
+func TestUploadsWaitForBufferMemory(t *testing.T) {
+  budget := newMemoryBudget(10 * mb)
+  assert.Nil(t, budget.acquire(context.Background(), 6 * mb))
+
+  acquired := make(chan error)
+  go func() { acquired <- budget.acquire(context.Background(), 6 * mb) }()
+
+  select {
+  case <-acquired:
+    t.Fatal("acquired more memory than the budget allows")
+  case <-time.After(50 * time.Millisecond):
+  }
+
+  budget.release(6 * mb)
+  assert.Nil(t, <-acquired)
+
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  assert.Equal(t, context.Canceled, budget.acquire(ctx, 6 * mb))
+
+  // a part bigger than the whole budget still goes when nothing else is held
+  budget.release(6 * mb)
+  assert.Nil(t, budget.acquire(context.Background(), 20 * mb))
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "net/http"
+  "sync"
+  "time"
+
+  "github.com/satori/go.uuid"
+)
+
+var (
+  notificationMaxRetries int
+  notificationPollIntervalSeconds int
+)
+
+func init() {
+  setFromENV("NOTIFICATION_MAX_RETRIES", &notificationMaxRetries, 5)
+  setFromENV("NOTIFICATION_POLL_INTERVAL_SECONDS", &notificationPollIntervalSeconds, 5)
+}
+
+var notificationClient = &http.Client{Timeout: 10 * time.Second}
+
+// Sent to a user's endpoint once one of their uploads is complete in S3. We
+// only know the SHA-256 when the whole file came through a single session,
+// resumed uploads just carry the ETag.
+type uploadNotification struct {
+  Event string `json:"event"`
+  AccessKey string `json:"access_key_id"`
+  SessionID uuid.UUID `json:"session_id"`
+  Bucket string `json:"bucket"`
+  Key string `json:"key"`
+  Size int64 `json:"size"`
+  SHA256 string `json:"sha256,omitempty"`
+  ETag string `json:"etag,omitempty"`
+  CompletedAt time.Time `json:"completed_at"`
+}
+
+// Where a user wants to hear about finished uploads
+type notificationEndpoint struct {
+  accessKey string
+  url string
+  secret []byte
+}
+
+// The user's active endpoint, nil if they haven't configured one
+func loadNotificationEndpoint(accessKey string) (*notificationEndpoint, error) {
+  if db == nil {
+    return nil, nil
+  }
+
+  var query = `
+    SELECT url, secret
+    FROM notification_endpoints
+    WHERE access_key_id = $1
+      AND active
+    ORDER BY created_at DESC
+    LIMIT 1;
+  `
+
+  n := &notificationEndpoint{accessKey: accessKey}
+  var secret string
+
+  err := db.QueryRow(query, accessKey).Scan(&n.url, &secret)
+  if err == sql.ErrNoRows {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  n.secret = []byte(secret)
+
+  return n, nil
+}
+
+// Queue the notification in pending_notifications, where it stays until it's
+// delivered or runs out of retries, so a restart doesn't lose it
+func (n *notificationEndpoint) notify(payload *uploadNotification) {
+  body, err := json.Marshal(payload)
+  if err != nil {
+    logger.Error("could not encode notification", "bucket", payload.Bucket, "key", payload.Key, "error", err)
+    return
+  }
+
+  if db == nil {
+    return
+  }
+
+  var query = `
+    INSERT INTO pending_notifications
+    (
+      access_key_id,
+      url,
+      secret,
+      payload
+    )
+    VALUES($1, $2, $3, $4);
+  `
+  _, err = db.Exec(query, n.accessKey, n.url, string(n.secret), body)
+  if err != nil {
+    logger.Error("could not queue notification", "access_key_id", n.accessKey, "url", n.url, "payload", string(body), "error", err)
+    return
+  }
+
+  select {
+  case notificationsReady <- struct{}{}:
+  default:
+  }
+}
+
+// A notification waiting in pending_notifications
+type pendingNotification struct {
+  id string
+  accessKey string
+  url string
+  secret []byte
+  body []byte
+  attempts int
+}
+
+// Wakes the delivery loop when a notification is queued
+var notificationsReady = make(chan struct{}, 1)
+
+// Claimed notifications are put back this far in the future, so that if this
+// server dies mid-delivery another one, or this one once it's back, retries them
+const notificationLease = 5 * time.Minute
+
+// Deliver due notifications until the process exits. Several servers can
+// share the table, each claims its own notifications.
+func runNotifications() {
+  ticker := time.NewTicker(time.Duration(notificationPollIntervalSeconds) * time.Second)
+  defer ticker.Stop()
+
+  for {
+    deliverDueNotifications()
+
+    select {
+    case <-ticker.C:
+    case <-notificationsReady:
+    }
+  }
+}
+
+func deliverDueNotifications() {
+  due, err := claimDueNotifications()
+  if err != nil {
+    logger.Error("could not load pending notifications", "error", err)
+    return
+  }
+
+  // one slow endpoint shouldn't hold up everyone else's notifications
+  var wg sync.WaitGroup
+  for _, p := range due {
+    wg.Add(1)
+    go func(p *pendingNotification) {
+      defer wg.Done()
+      p.settle(p.attempt())
+    }(p)
+  }
+  wg.Wait()
+}
+
+func claimDueNotifications() ([]*pendingNotification, error) {
+  var query = `
+    UPDATE pending_notifications
+    SET next_attempt_at = NOW() + $1 * interval '1 second',
+        updated_at = NOW()
+    WHERE id IN (
+      SELECT id
+      FROM pending_notifications
+      WHERE next_attempt_at <= NOW()
+      ORDER BY next_attempt_at
+      LIMIT 100
+      FOR UPDATE SKIP LOCKED
+    )
+    RETURNING id, access_key_id, url, secret, payload, attempts;
+  `
+
+  rows, err := db.Query(query, notificationLease.Seconds())
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  var due []*pendingNotification
+
+  for rows.Next() {
+    p := &pendingNotification{}
+    var secret string
+
+    if err := rows.Scan(&p.id, &p.accessKey, &p.url, &secret, &p.body, &p.attempts); err != nil {
+      return nil, err
+    }
+
+    p.secret = []byte(secret)
+    due = append(due, p)
+  }
+
+  return due, rows.Err()
+}
+
+// Try to deliver the notification once, returning how long to wait before the
+// next try. An error with no wait means it has run out of retries.
+func (p *pendingNotification) attempt() (time.Duration, error) {
+  err := postSigned(notificationClient, p.url, p.secret, p.body)
+  p.attempts++
+
+  if err == nil {
+    return 0, nil
+  }
+
+  if p.attempts > notificationMaxRetries {
+    return 0, err
+  }
+
+  return notificationBackoff(p.attempts), err
+}
+
+// Doubles from a second, capped at an hour
+func notificationBackoff(attempts int) (time.Duration) {
+  if attempts > 12 {
+    return time.Hour
+  }
+
+  backoff := time.Second << uint(attempts - 1)
+  if backoff > time.Hour {
+    return time.Hour
+  }
+
+  return backoff
+}
+
+// Record how the attempt went
+func (p *pendingNotification) settle(retryIn time.Duration, deliveryErr error) {
+  var err error
+
+  switch {
+  case deliveryErr == nil:
+    notificationsDelivered.Inc()
+    _, err = db.Exec(`DELETE FROM pending_notifications WHERE id = $1;`, p.id)
+  case retryIn == 0:
+    notificationsFailed.Inc()
+    err = p.deadLetter(deliveryErr)
+  default:
+    var query = `
+      UPDATE pending_notifications
+      SET attempts = $2,
+          last_error = $3,
+          next_attempt_at = NOW() + $4 * interval '1 second',
+          updated_at = NOW()
+      WHERE id = $1;
+    `
+    _, err = db.Exec(query, p.id, p.attempts, deliveryErr.Error(), retryIn.Seconds())
+  }
+
+  if err != nil {
+    logger.Error("could not update pending notification", "access_key_id", p.accessKey, "url", p.url, "error", err)
+  }
+}
+
+// Move a notification that never got through to notification_failures
+func (p *pendingNotification) deadLetter(deliveryErr error) (error) {
+  logger.Warn("could not deliver notification", "access_key_id", p.accessKey, "url", p.url, "attempts", p.attempts, "error", deliveryErr)
+
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+
+  var query = `
+    INSERT INTO notification_failures
+    (
+      access_key_id,
+      url,
+      payload,
+      error,
+      attempts
+    )
+    VALUES($1, $2, $3, $4, $5);
+  `
+  if _, err := tx.Exec(query, p.accessKey, p.url, p.body, deliveryErr.Error(), p.attempts); err != nil {
+    tx.Rollback()
+    return err
+  }
+
+  if _, err := tx.Exec(`DELETE FROM pending_notifications WHERE id = $1;`, p.id); err != nil {
+    tx.Rollback()
+    return err
+  }
+
+  return tx.Commit()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func TestNotificationsAreSigned(t *testing.T) {
+  var signature, timestamp string
+  var body []byte
+
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    signature = r.Header.Get("X-S3tp-Signature")
+    timestamp = r.Header.Get("X-S3tp-Timestamp")
+    body, _ = ioutil.ReadAll(r.Body)
+  }))
+  defer server.Close()
+
+  p := &pendingNotification{url: server.URL, secret: []byte("sekret"), body: []byte(`{"event":"upload.completed"}`)}
+
+  retryIn, err := p.attempt()
+  assert.Nil(t, err)
+  assert.Equal(t, time.Duration(0), retryIn)
+  assert.Equal(t, `{"event":"upload.completed"}`, string(body))
+  assert.Equal(t, "sha256=" + signPayload([]byte("sekret"), timestamp, body), signature)
+}
+
+func TestNotificationsBackOffThenDeadLetter(t *testing.T) {
+  requests := 0
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    requests++
+    w.WriteHeader(http.StatusServiceUnavailable)
+  }))
+  defer server.Close()
+
+  previous := notificationMaxRetries
+  notificationMaxRetries = 3
+  defer func() { notificationMaxRetries = previous }()
+
+  p := &pendingNotification{url: server.URL, body: []byte(`{}`)}
+
+  for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+    retryIn, err := p.attempt()
+    assert.NotNil(t, err)
+    assert.Equal(t, expected, retryIn)
+  }
+
+  // out of retries, no wait means it's dead-lettered
+  retryIn, err := p.attempt()
+  assert.NotNil(t, err)
+  assert.Equal(t, time.Duration(0), retryIn)
+  assert.Equal(t, 4, p.attempts)
+  assert.Equal(t, 4, requests)
+}
+
+func TestNotificationBackoffIsCapped(t *testing.T) {
+  assert.Equal(t, time.Hour, notificationBackoff(13))
+  assert.Equal(t, time.Hour, notificationBackoff(100))
+}
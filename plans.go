@@ -0,0 +1,216 @@
+package main
+
+import (
+  "database/sql"
+  "errors"
+  "fmt"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+var requireSubscription int
+
+func init() {
+  setFromENV("REQUIRE_SUBSCRIPTION", &requireSubscription, 0)
+}
+
+var (
+  errTransferQuotaExceeded = errors.New("Monthly transfer quota exceeded")
+  errMaxFileSizeExceeded = errors.New("Max upload size exceeded")
+)
+
+// Limits that come from the plan a user is subscribed to. In the plans table
+// a zero limit means the server-wide default applies, see planForUser.
+type plan struct {
+  readBytesPerSecond int64
+  writeBytesPerSecond int64
+  monthlyTransferBytes int64
+  maxFileSizeBytes int64
+  maxSessions int
+}
+
+// The plan for the user's active subscription, nil if they don't have one
+func loadPlan(accessKey string) (*plan, error) {
+  if db == nil {
+    return nil, nil
+  }
+
+  var query = `
+    SELECT
+      plans.read_bytes_per_second,
+      plans.write_bytes_per_second,
+      plans.monthly_transfer_bytes,
+      plans.max_file_size_bytes,
+      plans.max_sessions
+    FROM subscriptions
+    JOIN plans ON plans.id = subscriptions.plan_id
+    WHERE subscriptions.access_key_id = $1
+      AND subscriptions.active
+    ORDER BY subscriptions.created_at DESC
+    LIMIT 1;
+  `
+
+  p := &plan{}
+
+  err := db.QueryRow(query, accessKey).Scan(
+    &p.readBytesPerSecond,
+    &p.writeBytesPerSecond,
+    &p.monthlyTransferBytes,
+    &p.maxFileSizeBytes,
+    &p.maxSessions,
+  )
+  if err == sql.ErrNoRows {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  return p, nil
+}
+
+// The limits that apply to a user, their plan's where it sets them and the
+// server's configuration everywhere else. A plan that can't be loaded is an
+// error rather than the defaults, which could be more generous than the plan.
+func planForUser(accessKey string) (*plan, error) {
+  p := &plan{
+    readBytesPerSecond: int64(userReadBytesPerSecond),
+    writeBytesPerSecond: int64(userWriteBytesPerSecond),
+    maxFileSizeBytes: fileSizeLimitBytes,
+    maxSessions: maxConnectionsPerUser,
+  }
+
+  subscribed, err := loadPlan(accessKey)
+  if err != nil {
+    return nil, err
+  }
+  if subscribed == nil {
+    return p, nil
+  }
+
+  if subscribed.readBytesPerSecond > 0 {
+    p.readBytesPerSecond = subscribed.readBytesPerSecond
+  }
+  if subscribed.writeBytesPerSecond > 0 {
+    p.writeBytesPerSecond = subscribed.writeBytesPerSecond
+  }
+  if subscribed.monthlyTransferBytes > 0 {
+    p.monthlyTransferBytes = subscribed.monthlyTransferBytes
+  }
+  if subscribed.maxFileSizeBytes > 0 {
+    p.maxFileSizeBytes = subscribed.maxFileSizeBytes
+  }
+  if subscribed.maxSessions > 0 {
+    p.maxSessions = subscribed.maxSessions
+  }
+
+  return p, nil
+}
+
+// Refuse users whose subscriptions have all been deactivated. Users with no
+// subscription at all are only refused when REQUIRE_SUBSCRIPTION is set.
+func checkSubscription(accessKey string) (error) {
+  if db == nil {
+    return nil
+  }
+
+  var query = `
+    SELECT bool_or(active)
+    FROM subscriptions
+    WHERE access_key_id = $1;
+  `
+
+  var active sql.NullBool
+
+  if err := db.QueryRow(query, accessKey).Scan(&active); err != nil {
+    return err
+  }
+
+  if !active.Valid {
+    if requireSubscription != 0 {
+      return fmt.Errorf("No subscription for %q", accessKey)
+    }
+    return nil
+  }
+
+  if !active.Bool {
+    return fmt.Errorf("Subscription inactive for %q", accessKey)
+  }
+
+  return nil
+}
+
+// Bytes read and written by the user so far this calendar month
+func monthlyTransferUsed(accessKey string) (int64, error) {
+  if db == nil {
+    return 0, nil
+  }
+
+  var query = `
+    SELECT COALESCE(SUM(size), 0)
+    FROM events
+    WHERE access_key_id = $1
+      AND type IN ('READ', 'WRITE')
+      AND created_at >= date_trunc('month', NOW());
+  `
+
+  var used int64
+  err := db.QueryRow(query, accessKey).Scan(&used)
+
+  return used, err
+}
+
+// Transfer used by a user this month, shared by all of their sessions so that
+// parallel sessions can't each spend the whole of what's left of the quota
+type transferCounter struct {
+  used int64 // accessed atomically
+  month int
+}
+
+var userTransfers = make(map[string]*transferCounter)
+var userTransfersLock sync.Mutex
+
+func monthOf(t time.Time) (int) {
+  return t.Year() * 12 + int(t.Month())
+}
+
+// The user's counter, loaded from the events table the first time it's needed
+// each month
+func transferForUser(accessKey string) (*transferCounter, error) {
+  userTransfersLock.Lock()
+  defer userTransfersLock.Unlock()
+
+  month := monthOf(time.Now())
+
+  t, ok := userTransfers[accessKey]
+  if ok && t.month == month {
+    return t, nil
+  }
+
+  used, err := monthlyTransferUsed(accessKey)
+  if err != nil {
+    return nil, err
+  }
+
+  t = &transferCounter{used: used, month: month}
+  userTransfers[accessKey] = t
+
+  return t, nil
+}
+
+// Count n more bytes, refusing them if they'd take the user over limit
+func (t *transferCounter) reserve(n int, limit int64) (error) {
+  used := atomic.AddInt64(&t.used, int64(n))
+
+  if limit > 0 && used > limit {
+    atomic.AddInt64(&t.used, -int64(n))
+    return errTransferQuotaExceeded
+  }
+
+  return nil
+}
+
+func (t *transferCounter) refund(n int) {
+  atomic.AddInt64(&t.used, -int64(n))
+}
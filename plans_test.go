@@ -0,0 +1,23 @@
+package main
+
+import (
+  "testing"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func TestTransferIsSharedAcrossSessions(t *testing.T) {
+  first, err := transferForUser("AKIATRANSFERSHARED01")
+  assert.Nil(t, err)
+  second, err := transferForUser("AKIATRANSFERSHARED01")
+  assert.Nil(t, err)
+  assert.True(t, first == second)
+
+  assert.Nil(t, first.reserve(600, 1000))
+  // the other session only gets what's left of the quota
+  assert.Equal(t, errTransferQuotaExceeded, second.reserve(600, 1000))
+  assert.Nil(t, second.reserve(400, 1000))
+
+  first.refund(400)
+  assert.Nil(t, second.reserve(400, 1000))
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+  "context"
+  "fmt"
+  "io"
+  "sync"
+
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/awserr"
+  "github.com/aws/aws-sdk-go/service/s3"
+)
+
+var (
+  readAheadChunkMB int
+  readAheadMaxChunks int
+  readAheadMemoryMB int
+)
+
+func init() {
+  setFromENV("READ_AHEAD_CHUNK_MB", &readAheadChunkMB, 8)
+  setFromENV("READ_AHEAD_MAX_CHUNKS", &readAheadMaxChunks, 8)
+  setFromENV("READ_AHEAD_MEMORY_MB", &readAheadMemoryMB, 512)
+
+  if readAheadChunkMB < 1 {
+    readAheadChunkMB = 1
+  }
+  if readAheadMaxChunks < 1 {
+    readAheadMaxChunks = 1
+  }
+
+  slots := readAheadMemoryMB / readAheadChunkMB
+  if slots < 1 {
+    slots = 1
+  }
+  readAheadSlots = make(chan struct{}, slots)
+}
+
+// Every chunk fetched ahead of what a reader needs next holds a slot, this is
+// what bounds read-ahead memory across all downloads. The chunk a reader needs
+// next doesn't, otherwise a few stalled readers could hold every slot and
+// leave everyone else waiting.
+var readAheadSlots chan struct{}
+
+var readAheadBuffers = sync.Pool{
+  New: func() interface{} { return make([]byte, int64(readAheadChunkMB) * mb) },
+}
+
+type readAheadChunk struct {
+  offset int64
+  length int64
+  data []byte
+  n int
+  err error
+  done chan struct{}
+  reserved bool // uses the reader's own slot rather than one of readAheadSlots
+}
+
+func (c *readAheadChunk) ready() (bool) {
+  select {
+  case <-c.done:
+    return true
+  default:
+    return false
+  }
+}
+
+// Reads an object front to back with ranged GETs running ahead of the
+// reader. The window of chunks in flight starts small and grows whenever the
+// reader has to wait on the network, and shrinks again when chunks pile up
+// unread.
+type readAheadReader struct {
+  getRange func(ctx context.Context, offset, length int64) (io.ReadCloser, error)
+  ctx context.Context
+  cancel context.CancelFunc
+  size int64
+  chunkSize int64
+
+  window int
+  chunks []*readAheadChunk
+  nextOffset int64
+  position int // within chunks[0]
+  reserved bool // a chunk is using the reader's own slot
+  fetching sync.WaitGroup
+}
+
+// env is the object's data key when it was encrypted client-side, size is
+// always the size of the plaintext
+func newReadAheadReader(ctx context.Context, client *s3.S3, bucket, key string, versionID *string, size int64, encryption *encryptionSettings, env *envelope) (*readAheadReader) {
+  getRange := func(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+    input := &s3.GetObjectInput{
+      Bucket: aws.String(bucket),
+      Key: aws.String(key),
+      VersionId: versionID,
+      Range: aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset + length - 1)),
+    }
+    encryption.applyToGet(input)
+
+    output, err := client.GetObjectWithContext(ctx, input)
+    if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidObjectState" {
+      return nil, errArchived
+    }
+    if err != nil {
+      return nil, err
+    }
+
+    return output.Body, nil
+  }
+
+  if env != nil {
+    getRange = env.decryptRanges(getRange, size)
+  }
+
+  return newRangeReader(ctx, getRange, size)
+}
+
+func newRangeReader(ctx context.Context, getRange func(context.Context, int64, int64) (io.ReadCloser, error), size int64) (*readAheadReader) {
+  ctx, cancel := context.WithCancel(ctx)
+
+  window := 2
+  if window > readAheadMaxChunks {
+    window = readAheadMaxChunks
+  }
+
+  return &readAheadReader{
+    getRange: getRange,
+    ctx: ctx,
+    cancel: cancel,
+    size: size,
+    chunkSize: int64(readAheadChunkMB) * mb,
+    window: window,
+  }
+}
+
+// Fills p unless the object ends first
+func (r *readAheadReader) Read(p []byte) (int, error) {
+  read := 0
+
+  for read < len(p) {
+    if err := r.fill(); err != nil {
+      return read, err
+    }
+
+    if len(r.chunks) == 0 {
+      return read, io.EOF
+    }
+
+    c := r.chunks[0]
+
+    if r.position == 0 {
+      r.adapt(c)
+    }
+    <-c.done
+
+    if c.err != nil {
+      return read, c.err
+    }
+
+    n := copy(p[read:], c.data[r.position:c.n])
+    read += n
+    r.position += n
+
+    if r.position >= c.n {
+      r.chunks = r.chunks[1:]
+      r.position = 0
+      r.release(c)
+
+      // the object is shorter than it was when we looked at it
+      if int64(c.n) < c.length {
+        r.size = c.offset + int64(c.n)
+        r.discard()
+      }
+    }
+  }
+
+  return read, nil
+}
+
+// Start fetching chunks until the window is full. Each reader has a slot of
+// its own, which is always free by the time it runs out of chunks, so it never
+// waits for memory. Anything past that is only fetched if memory is free.
+func (r *readAheadReader) fill() (error) {
+  if err := r.ctx.Err(); err != nil {
+    return err
+  }
+
+  for len(r.chunks) < r.window && r.nextOffset < r.size {
+    reserved := !r.reserved
+    if !reserved {
+      select {
+      case readAheadSlots <- struct{}{}:
+      default:
+        return nil
+      }
+    }
+
+    length := r.chunkSize
+    if r.nextOffset + length > r.size {
+      length = r.size - r.nextOffset
+    }
+
+    c := &readAheadChunk{offset: r.nextOffset, length: length, done: make(chan struct{}), reserved: reserved}
+    r.reserved = true
+    r.nextOffset += length
+    r.chunks = append(r.chunks, c)
+
+    readAheadBuffersInUse.Inc()
+    r.fetching.Add(1)
+    go r.fetch(c)
+  }
+
+  return nil
+}
+
+func (r *readAheadReader) fetch(c *readAheadChunk) {
+  defer r.fetching.Done()
+  defer close(c.done)
+
+  c.data = readAheadBuffers.Get().([]byte)
+
+  body, err := r.getRange(r.ctx, c.offset, c.length)
+
+  // past the end of an object that got shorter, Read treats it as the end
+  if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidRange" {
+    return
+  }
+  if err != nil {
+    c.err = err
+    return
+  }
+  defer body.Close()
+
+  c.n, c.err = io.ReadFull(body, c.data[:c.length])
+  if c.err == io.ErrUnexpectedEOF || c.err == io.EOF {
+    c.err = nil
+  }
+}
+
+// A reader that had to wait is network bound so more should be in flight,
+// when the next chunks are all ready too the window is bigger than needed.
+func (r *readAheadReader) adapt(c *readAheadChunk) {
+  if !c.ready() {
+    if r.window < readAheadMaxChunks {
+      r.window++
+    }
+    return
+  }
+
+  if len(r.chunks) >= r.window && r.window > 1 && r.chunks[len(r.chunks) - 1].ready() {
+    r.window--
+  }
+}
+
+func (r *readAheadReader) release(c *readAheadChunk) {
+  if c.data != nil {
+    readAheadBuffers.Put(c.data)
+    c.data = nil
+  }
+
+  if c.reserved {
+    r.reserved = false
+  } else {
+    <-readAheadSlots
+  }
+  readAheadBuffersInUse.Dec()
+}
+
+// Drop everything that's been fetched or is being fetched
+func (r *readAheadReader) discard() {
+  chunks := r.chunks
+  r.chunks = nil
+  r.nextOffset = r.size
+
+  for _, c := range chunks {
+    <-c.done
+    r.release(c)
+  }
+}
+
+func (r *readAheadReader) Close() (error) {
+  r.cancel()
+  r.discard()
+  r.fetching.Wait()
+
+  return nil
+}
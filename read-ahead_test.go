@@ -0,0 +1,146 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "errors"
+  "io"
+  "io/ioutil"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "github.com/aws/aws-sdk-go/aws/awserr"
+  "github.com/stretchr/testify/assert"
+)
+
+func rangesOf(object []byte, requests *int32) (func(context.Context, int64, int64) (io.ReadCloser, error)) {
+  return func(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+    atomic.AddInt32(requests, 1)
+
+    if offset >= int64(len(object)) {
+      return nil, awserr.New("InvalidRange", "The requested range is not satisfiable", nil)
+    }
+
+    end := offset + length
+    if end > int64(len(object)) {
+      end = int64(len(object))
+    }
+
+    return ioutil.NopCloser(bytes.NewReader(object[offset:end])), nil
+  }
+}
+
+func TestReadAheadReadsTheWholeObjectInOrder(t *testing.T) {
+  object := make([]byte, 3 * int(mb) + 12345)
+  for i := range object {
+    object[i] = byte(i % 251)
+  }
+
+  previous := readAheadChunkMB
+  readAheadChunkMB = 1
+  defer func() { readAheadChunkMB = previous }()
+
+  var requests int32
+  r := newRangeReader(context.Background(), rangesOf(object, &requests), int64(len(object)))
+  r.chunkSize = mb
+
+  read, err := ioutil.ReadAll(r)
+  assert.Nil(t, err)
+  assert.True(t, bytes.Equal(object, read))
+  assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+
+  assert.Nil(t, r.Close())
+  assert.Equal(t, 0, len(readAheadSlots))
+}
+
+func TestReadAheadStopsAtAShorterObject(t *testing.T) {
+  object := []byte("hello world!")
+
+  var requests int32
+  r := newRangeReader(context.Background(), rangesOf(object, &requests), 1000)
+  r.chunkSize = 4
+
+  read, err := ioutil.ReadAll(r)
+  assert.Nil(t, err)
+  assert.Equal(t, "hello world!", string(read))
+
+  r.Close()
+  assert.Equal(t, 0, len(readAheadSlots))
+}
+
+func TestReadAheadReturnsFetchErrors(t *testing.T) {
+  failure := errors.New("AccessDenied")
+  r := newRangeReader(context.Background(), func(context.Context, int64, int64) (io.ReadCloser, error) {
+    return nil, failure
+  }, 10)
+
+  _, err := r.Read(make([]byte, 10))
+  assert.Equal(t, failure, err)
+
+  r.Close()
+  assert.Equal(t, 0, len(readAheadSlots))
+}
+
+func TestSessionEndReleasesUnclosedReads(t *testing.T) {
+  ctx, cancel := context.WithCancel(context.Background())
+  fetching := make(chan struct{}, 1)
+
+  fs := &s3fs{openReaders: make(map[*s3File]struct{})}
+  f := &s3File{name: "/s3tp-test/hello", bucket: "s3tp-test", key: "hello", s3fs: fs}
+  f.streamingReader = newRangeReader(ctx, func(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+    fetching <- struct{}{}
+    <-ctx.Done()
+    return nil, ctx.Err()
+  }, 10)
+  fs.track_reader(f)
+
+  read := make(chan error)
+  go func() {
+    _, err := f.readAt(make([]byte, 10), 0)
+    read <- err
+  }()
+  <-fetching
+
+  cancel()
+  fs.close_open_readers()
+
+  assert.Equal(t, context.Canceled, <-read)
+  assert.Nil(t, f.streamingReader)
+  assert.Equal(t, 0, len(fs.openReaders))
+  assert.Equal(t, 0, len(readAheadSlots))
+}
+
+func TestStalledReadersDontHoldUpOthers(t *testing.T) {
+  previous := readAheadSlots
+  readAheadSlots = make(chan struct{}, 2)
+  defer func() { readAheadSlots = previous }()
+
+  // fetched everything it could and then stopped reading
+  var requests int32
+  stalled := newRangeReader(context.Background(), rangesOf(make([]byte, 100), &requests), 100)
+  stalled.chunkSize = 10
+  stalled.window = 8
+  _, err := stalled.Read(make([]byte, 1))
+  assert.Nil(t, err)
+  assert.Equal(t, 2, len(readAheadSlots))
+
+  done := make(chan []byte)
+  go func() {
+    r := newRangeReader(context.Background(), rangesOf([]byte("hello world!"), &requests), 12)
+    r.chunkSize = 4
+    read, _ := ioutil.ReadAll(r)
+    r.Close()
+    done <- read
+  }()
+
+  select {
+  case read := <-done:
+    assert.Equal(t, "hello world!", string(read))
+  case <-time.After(5 * time.Second):
+    t.Fatal("reader waited on the stalled reader's slots")
+  }
+
+  stalled.Close()
+  assert.Equal(t, 0, len(readAheadSlots))
+}
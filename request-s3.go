@@ -1,22 +1,94 @@
 package main
 
 import (
+  "context"
+  "encoding/binary"
   "errors"
   "io"
+  "net"
+  "net/url"
   "os"
   "sort"
   "strings"
-  _ "log"
+  "sync"
+  "log/slog"
+  "time"
 
   "github.com/aws/aws-sdk-go/aws"
   "github.com/aws/aws-sdk-go/service/s3"
   "github.com/pkg/sftp"
   "github.com/satori/go.uuid"
-  _"github.com/rlmcpherson/s3gof3r"
+  "golang.org/x/crypto/ssh"
 )
 
 var delimiter = "/"
 
+var (
+  errUnsupported = errors.New("Operation not supported")
+  errUploadInterrupted = errors.New("Upload interrupted")
+  errOverlappingWrite = errors.New("Write overlaps data already uploaded")
+)
+
+// SFTP open flags (pflags), the sftp package keeps its own copies unexported
+const (
+  sshFxfRead   = 0x00000001
+  sshFxfWrite  = 0x00000002
+  sshFxfAppend = 0x00000004
+  sshFxfCreat  = 0x00000008
+  sshFxfTrunc  = 0x00000010
+  sshFxfExcl   = 0x00000020
+)
+
+const (
+  sshFileXferAttrSize = 0x00000001
+  sshFileXferAttrUIDGID = 0x00000002
+  sshFileXferAttrPermissions = 0x00000004
+  sshFileXferAttrACModTime = 0x00000008
+)
+
+// Only an explicit append (OpenSSH's reput and put -a) picks up an interrupted
+// upload. Any other open starts over, even without O_TRUNC, so a new file is
+// never spliced onto what's left of an old one.
+func resumeRequested(pflags uint32) (bool) {
+  return pflags&sshFxfAppend != 0
+}
+
+// The size a client sent along with its open request, 0 if it didn't. Most
+// clients don't, but when they do the upload can pick its part size up front.
+func declaredSize(attrs []byte) (int64) {
+  if len(attrs) < 12 || binary.BigEndian.Uint32(attrs)&sshFileXferAttrSize == 0 {
+    return 0
+  }
+
+  return int64(binary.BigEndian.Uint64(attrs[4:]))
+}
+
+// The modification time a client sent along with its open request, zero if
+// it didn't.
+func declaredModTime(attrs []byte) (time.Time) {
+  if len(attrs) < 4 {
+    return time.Time{}
+  }
+
+  flags := binary.BigEndian.Uint32(attrs)
+  offset := 4
+
+  if flags&sshFileXferAttrSize != 0 {
+    offset += 8
+  }
+  if flags&sshFileXferAttrUIDGID != 0 {
+    offset += 8
+  }
+  if flags&sshFileXferAttrPermissions != 0 {
+    offset += 4
+  }
+  if flags&sshFileXferAttrACModTime == 0 || len(attrs) < offset + 8 {
+    return time.Time{}
+  }
+
+  return time.Unix(int64(binary.BigEndian.Uint32(attrs[offset + 4:])), 0)
+}
+
 type s3listerat []os.FileInfo
 
 // Modeled after strings.Reader's ReadAt() implementation
@@ -32,15 +104,66 @@ func (f s3listerat) ListAt(ls []os.FileInfo, offset int64) (int, error) {
   return n, nil
 }
 
-func S3Handler(accessKey, secretKey string) sftp.Handlers {
+// Handlers for one session. Settings that would loosen a user's limits or
+// protections if they were missing fail the session rather than defaulting.
+func S3Handler(accessKey, secretKey string, p *plan) (sftp.Handlers, error) {
+  sessionID := uuid.NewV4()
+  sessionLog := logger.With("session_id", sessionID.String(), "access_key_id", accessKey)
+
+  transfer, err := transferForUser(accessKey)
+  if err != nil {
+    sessionLog.Error("could not load transfer usage", "error", err)
+    return sftp.Handlers{}, err
+  }
+
+  notifier, err := loadNotificationEndpoint(accessKey)
+  if err != nil {
+    sessionLog.Error("could not load notification endpoint", "error", err)
+    return sftp.Handlers{}, err
+  }
+
+  encryption, err := loadEncryptionSettings(accessKey)
+  if err != nil {
+    sessionLog.Error("could not load encryption settings", "error", err)
+    return sftp.Handlers{}, err
+  }
+
+  taggingRules, err := loadTaggingRules(accessKey)
+  if err != nil {
+    sessionLog.Error("could not load tagging rules", "error", err)
+    return sftp.Handlers{}, err
+  }
+
+  storage, err := loadStorageSettings(accessKey)
+  if err != nil {
+    sessionLog.Error("could not load storage settings", "error", err)
+    return sftp.Handlers{}, err
+  }
+
+  janitor.adopt(accessKey, secretKey)
+
   s3fs := &s3fs{
     S3: s3Client(accessKey, secretKey),
     accessKey: accessKey,
     secretKey: secretKey,
-    sessionID: uuid.NewV4(),
+    sessionID: sessionID,
+    openWriters: make(map[*s3File]struct{}),
+    openReaders: make(map[*s3File]struct{}),
+    throttle: throttleForUser(accessKey, p),
+    plan: p,
+    transfer: transfer,
+    notifier: notifier,
+    startedAt: time.Now(),
+    ctx: context.Background(),
+    log: sessionLog,
+    metadata: metadataCacheFor(),
+    cacheScope: metadataCacheScope(accessKey, secretKey),
+    encryption: encryption,
+    taggingRules: taggingRules,
+    storage: storage,
   }
 
-  return sftp.Handlers{s3fs, s3fs, s3fs, s3fs}
+  return sftp.Handlers{s3fs, s3fs, s3fs, s3fs}, nil
 }
 
 // file-system-y thing that the Hanlders live on
@@ -49,21 +172,174 @@ type s3fs struct {
   accessKey string
   secretKey string
   sessionID uuid.UUID
+  openWriters map[*s3File]struct{}
+  openReaders map[*s3File]struct{}
+  filesLock sync.Mutex
+  throttle *throttle
+  plan *plan
+  remoteAddr string
+  clientVersion string
+  notifier *notificationEndpoint
+  transfer *transferCounter // shared with the user's other sessions
+  startedAt time.Time
+  bytesRead int64 // accessed atomically
+  bytesWritten int64 // accessed atomically
+  ctx context.Context // the session's span
+  log *slog.Logger
+  metadata *metadataCache // nil when caching is off
+  cacheScope string // prefixes this session's cache keys
+  encryption map[string]*encryptionSettings // by bucket, see encryption_for
+  taggingRules []*taggingRule
+  storage map[string]*storageSettings // by bucket, see storage_for
+  versioning map[string]bool // by bucket, see bucket_versioned
+  versioningLock sync.Mutex
 }
 
-func (fs *s3fs) file_for_path(p string) (*s3File, error) {
+// Count n more bytes against the user's monthly transfer quota
+func (fs *s3fs) reserve_transfer(n int) (error) {
+  return fs.transfer.reserve(n, fs.plan.monthlyTransferBytes)
+}
+
+// Give back bytes that were reserved but never transferred
+func (fs *s3fs) refund_transfer(n int) {
+  fs.transfer.refund(n)
+}
+
+// Remember where the session came from for its events
+func (fs *s3fs) set_connection(conn ssh.ConnMetadata) {
+  fs.remoteAddr = conn.RemoteAddr().String()
+  if host, _, err := net.SplitHostPort(fs.remoteAddr); err == nil {
+    fs.remoteAddr = host
+  }
+  fs.clientVersion = string(conn.ClientVersion())
+  fs.log = fs.log.With("remote_addr", fs.remoteAddr)
+}
+
+func (fs *s3fs) track_writer(f *s3File) {
+  fs.filesLock.Lock()
+  defer fs.filesLock.Unlock()
+
+  fs.openWriters[f] = struct{}{}
+  transfersInFlight.WithLabelValues("write").Inc()
+}
+
+// The file open for writing at p in this session, nil if there isn't one
+func (fs *s3fs) open_writer(p string) (*s3File) {
+  fs.filesLock.Lock()
+  defer fs.filesLock.Unlock()
+
+  for f, _ := range fs.openWriters {
+    if f.name == p {
+      return f
+    }
+  }
+
+  return nil
+}
+
+func (fs *s3fs) untrack_writer(f *s3File) {
+  fs.filesLock.Lock()
+  defer fs.filesLock.Unlock()
+
+  if _, ok := fs.openWriters[f]; ok {
+    delete(fs.openWriters, f)
+    transfersInFlight.WithLabelValues("write").Dec()
+  }
+}
+
+func (fs *s3fs) track_reader(f *s3File) {
+  fs.filesLock.Lock()
+  defer fs.filesLock.Unlock()
+
+  fs.openReaders[f] = struct{}{}
+  transfersInFlight.WithLabelValues("read").Inc()
+}
+
+func (fs *s3fs) untrack_reader(f *s3File) {
+  fs.filesLock.Lock()
+  defer fs.filesLock.Unlock()
+
+  if _, ok := fs.openReaders[f]; ok {
+    delete(fs.openReaders, f)
+    transfersInFlight.WithLabelValues("read").Dec()
+  }
+}
+
+// Abort every upload in this session that the client didn't close, otherwise
+// the incomplete multipart uploads sit in the bucket and get billed forever.
+func (fs *s3fs) abort_open_writers() {
+  fs.filesLock.Lock()
+  writers := fs.openWriters
+  fs.openWriters = make(map[*s3File]struct{})
+  fs.filesLock.Unlock()
+
+  transfersInFlight.WithLabelValues("write").Sub(float64(len(writers)))
+
+  for f, _ := range writers {
+    if err := f.Abort(); err != nil {
+      fs.log.Error("could not abort upload", "bucket", f.bucket, "key", f.key, "error", err)
+    }
+  }
+}
+
+// Close every download the client didn't, otherwise their read-ahead slots
+// and buffers are never given back and other sessions' reads stall waiting
+// for them. The session context must already be cancelled so a read blocked
+// on a fetch lets go of the file.
+func (fs *s3fs) close_open_readers() {
+  fs.filesLock.Lock()
+  readers := fs.openReaders
+  fs.openReaders = make(map[*s3File]struct{})
+  fs.filesLock.Unlock()
+
+  transfersInFlight.WithLabelValues("read").Sub(float64(len(readers)))
+
+  for f, _ := range readers {
+    if err := f.Close(); err != nil {
+      fs.log.Error("could not close download", "bucket", f.bucket, "key", f.key, "error", err)
+    }
+  }
+}
+
+// An interrupted upload reports how much of it we have so that clients know
+// where to resume from. Only Stat does this, reads, renames and the rest work
+// on the object that's actually there.
+func (fs *s3fs) stat(ctx context.Context, p string) (*s3File, error) {
+  if parseVersionPath(p) == nil {
+    bucket, key := bucket_parts_from_filepath(p)
+
+    if state, _ := loadUploadState(fs.accessKey, bucket, key); state != nil {
+      return &s3File{name: p, key: key, size: state.size, bucket: bucket, s3fs: fs}, nil
+    }
+  }
+
+  return fs.file_for_path(ctx, p)
+}
+
+func (fs *s3fs) file_for_path(ctx context.Context, p string) (*s3File, error) {
+  if v := parseVersionPath(p); v != nil {
+    return fs.version_file(ctx, v, p)
+  }
+
   bucket, key := bucket_parts_from_filepath(p)
 
+  if file := fs.cached_stat(p); file != nil {
+    return file, nil
+  }
+
   input := &s3.HeadObjectInput{
       Bucket: aws.String(bucket),
       Key:    aws.String(key),
   }
+  fs.encryption_for(bucket).applyToHead(input)
 
-  output, err := fs.HeadObject(input)
+  output, err := fs.HeadObjectWithContext(ctx, input)
 
   if err != nil {
-    if len(fs.files_for_path(p)) > 0 {
-      return &s3File{name: p, isdir: true}, nil
+    if len(fs.files_for_path(ctx, p)) > 0 {
+      dir := &s3File{name: p, isdir: true}
+      fs.cache_stat(p, dir)
+      return dir, nil
     }
     return nil, err
   }
@@ -74,17 +350,34 @@ func (fs *s3fs) file_for_path(p string) (*s3File, error) {
     key: key,
     size: *output.ContentLength,
     bucket: bucket,
+    archived: isArchived(output.StorageClass, output.Restore),
     s3fs: fs,
   }
 
+  if isEnvelope(output.Metadata) {
+    file.size = plaintextSize(file.size)
+  }
+
+  fs.cache_stat(p, file)
+
   return file, nil
 }
 
-func (fs *s3fs) files_for_path(p string) (map[string]*s3File) {
+func (fs *s3fs) files_for_path(ctx context.Context, p string) (map[string]*s3File) {
+  if v := parseVersionPath(p); v != nil {
+    return fs.version_listing(ctx, v)
+  }
+
+  if files := fs.cached_listing(p); files != nil {
+    return files
+  }
+
   files := make(map[string]*s3File)
+  var err error
 
   if p == "/" {
-    bucket_results, _ := fs.ListBuckets(&s3.ListBucketsInput{})
+    var bucket_results *s3.ListBucketsOutput
+    bucket_results, err = fs.ListBucketsWithContext(ctx, &s3.ListBucketsInput{})
 
     for _, bucket := range bucket_results.Buckets {
       files[*bucket.Name] = &s3File{name: *bucket.Name, isdir: true}
@@ -103,7 +396,8 @@ func (fs *s3fs) files_for_path(p string) (map[string]*s3File) {
         Prefix: &prefix,
     }
 
-    result, _ := fs.ListObjectsV2(input)
+    var result *s3.ListObjectsV2Output
+    result, err = fs.ListObjectsV2WithContext(ctx, input)
 
     for _, f  := range result.Contents {
       if *f.Key == prefix {
@@ -111,7 +405,11 @@ func (fs *s3fs) files_for_path(p string) (map[string]*s3File) {
       }
 
       name := strings.TrimPrefix(*f.Key, prefix)
-      files[*f.Key] = &s3File{name: name, bucket: bucket, key: *f.Key}
+      files[*f.Key] = &s3File{name: name, bucket: bucket, key: *f.Key, size: aws.Int64Value(f.Size), archived: isArchived(f.StorageClass, nil)}
+    }
+
+    if err == nil && fs.encryption_for(bucket).client_side() {
+      fs.envelope_sizes(ctx, files)
     }
 
     for _, f  := range result.CommonPrefixes {
@@ -119,16 +417,29 @@ func (fs *s3fs) files_for_path(p string) (map[string]*s3File) {
       dir := strings.TrimSuffix(path, delimiter)
       files[*f.Prefix] = &s3File{name: dir, bucket: bucket, isdir: true}
     }
+
+    if err == nil && versionsDirectory != 0 && fs.bucket_versioned(ctx, bucket) {
+      files[prefix + versionsDirName + delimiter] = &s3File{name: versionsDirName, bucket: bucket, isdir: true}
+    }
+  }
+
+  if err == nil {
+    fs.cache_listing(p, files)
   }
 
   return files
 }
 
 func (fs *s3fs) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+  started := time.Now()
+  bucket, key := bucket_parts_from_filepath(r.Filepath)
+
+  ctx, span := fs.start_span(r)
+
   switch r.Method {
   case "List":
     ordered_names := []string{}
-    files := fs.files_for_path(r.Filepath)
+    files := fs.files_for_path(ctx, r.Filepath)
 
     for fn, _ := range files { ordered_names = append(ordered_names, fn) }
 
@@ -140,51 +451,185 @@ func (fs *s3fs) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
       list[i] = files[fn]
     }
 
-    go persist_event(fs.sessionID, fs.accessKey, "LIST", 0)
+    fs.persist_event(&event{Category: "LIST", Bucket: bucket, Key: key, StartedAt: started}, nil)
+    fs.observe_request(r, started, nil)
+    endSpan(span, nil)
     return s3listerat(list), nil
   case "Stat":
-    file, err := fs.file_for_path(r.Filepath)
+    file, err := fs.stat(ctx, r.Filepath)
+
+    fs.persist_event(&event{Category: "STAT", Bucket: bucket, Key: key, StartedAt: started}, err)
+    fs.observe_request(r, started, err)
+    endSpan(span, err)
 
     if err != nil {
       return nil, err
     }
 
-    go persist_event(fs.sessionID, fs.accessKey, "STAT", 0)
     return s3listerat([]os.FileInfo{file}), nil
   }
+
+  span.End()
   return nil, nil
 }
 
 func (fs *s3fs) Fileread(r *sftp.Request) (io.ReaderAt, error) {
-  file, err := fs.file_for_path(r.Filepath)
+  started := time.Now()
+
+  ctx, span := fs.start_span(r)
+  file, err := fs.file_for_path(ctx, r.Filepath)
+
+  if err == nil {
+    err = file.check_archived(ctx)
+  }
+
+  if err == nil {
+    file.openedAt = started
+    err = file.OpenStreamingReader(ctx)
+  }
+
+  if err == nil {
+    fs.track_reader(file)
+  }
+
+  fs.observe_request(r, started, err)
+  endSpan(span, err)
 
   if err != nil {
+    bucket, key := bucket_parts_from_filepath(r.Filepath)
+    fs.persist_event(&event{Category: "READ", Bucket: bucket, Key: key, StartedAt: started}, err)
     return nil, err
   }
 
-  err = file.OpenStreamingReader(fs.accessKey, fs.secretKey)
-
-  return io.ReaderAt(file), err
+  return io.ReaderAt(file), nil
 }
 
 func (fs *s3fs) Filecmd(r *sftp.Request) error {
-  return errors.New("foobar")
+  bucket, key := bucket_parts_from_filepath(r.Filepath)
+
+  ctx, span := fs.start_span(r)
+  started := time.Now()
+
+  err := errUnsupported
+  switch r.Method {
+  case "Rename":
+    err = fs.rename(ctx, r.Filepath, r.Target)
+  case "Setstat":
+    err = fs.setstat(ctx, r.Filepath, r.Attrs)
+  }
+
+  fs.observe_request(r, started, err)
+  endSpan(span, err)
+
+  e := &event{Category: strings.ToUpper(r.Method), Bucket: bucket, Key: key}
+  if r.Method == "Rename" {
+    e.OldPath = r.Filepath
+    e.NewPath = r.Target
+  }
+
+  fs.persist_event(e, err)
+
+  return err
+}
+
+// S3 has no rename, copy the object and delete the original. Directories and
+// objects too big for a single CopyObject aren't supported. Renaming an older
+// version copies it, which restores it when it's renamed over the current
+// object, and leaves the version where it was.
+func (fs *s3fs) rename(ctx context.Context, from, to string) (error) {
+  if parseVersionPath(to) != nil {
+    return errUnsupported
+  }
+
+  file, err := fs.file_for_path(ctx, from)
+  if err != nil {
+    return err
+  }
+
+  if file.isdir || file.size > maxCopySize {
+    return errUnsupported
+  }
+
+  toBucket, toKey := bucket_parts_from_filepath(to)
+  if toKey == "" {
+    return errUnsupported
+  }
+
+  if err := fs.copy_object(ctx, file.bucket, file.key, file.versionID, toBucket, toKey); err != nil {
+    return err
+  }
+  fs.invalidate_path(to)
+
+  if file.versionID != "" {
+    return nil
+  }
+
+  _, err = fs.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+    Bucket: aws.String(file.bucket),
+    Key: aws.String(file.key),
+  })
+  fs.invalidate_path(from)
+
+  return err
+}
+
+// Copy an object within S3 under the encryption settings of both ends, S3
+// only copies objects up to 5 GB in one request. An empty versionID copies
+// the current version.
+func (fs *s3fs) copy_object(ctx context.Context, fromBucket, fromKey, versionID, toBucket, toKey string) (error) {
+  source := (&url.URL{Path: fromBucket + delimiter + fromKey}).EscapedPath()
+  if versionID != "" {
+    source += "?versionId=" + url.QueryEscape(versionID)
+  }
+
+  input := &s3.CopyObjectInput{
+    Bucket: aws.String(toBucket),
+    Key: aws.String(toKey),
+    CopySource: aws.String(source),
+    StorageClass: fs.storage_for(toBucket).class(),
+  }
+  encryption := fs.encryption_for(toBucket)
+  encryption.applyToCopy(input, fs.encryption_for(fromBucket))
+
+  _, err := fs.CopyObjectWithContext(ctx, input, encryption.requestOptions()...)
+
+  return err
 }
 
 func (fs *s3fs) Filewrite(r *sftp.Request) (io.WriterAt, error) {
   bucket, key := bucket_parts_from_filepath(r.Filepath)
 
+  ctx, span := fs.start_span(r)
+
   file := &s3File{
     name: r.Filepath,
     isdir: false,
     key: key,
     bucket: bucket,
+    size: declaredSize(r.Attrs),
+    modtime: declaredModTime(r.Attrs),
+    openedAt: time.Now(),
     s3fs: fs,
   }
 
-  _, err := file.OpenStreamingWriter(fs.accessKey, fs.secretKey)
+  resume := resumeRequested(r.Flags)
+
+  // versions are read-only
+  err := errUnsupported
+  if parseVersionPath(r.Filepath) == nil {
+    _, err = file.OpenStreamingWriter(ctx, resume)
+  }
+  fs.observe_request(r, file.openedAt, err)
+  endSpan(span, err)
 
-  return file, err
+  if err != nil {
+    fs.persist_event(&event{Category: "WRITE", Bucket: bucket, Key: key, StartedAt: file.openedAt}, err)
+    return nil, err
+  }
+
+  janitor.remember(fs.accessKey, fs.secretKey, bucket, key)
+
+  return file, nil
 }
 
 func bucket_parts_from_filepath(p string) (bucket, path string) {
@@ -133,7 +133,11 @@ func clientRequestServerPair(t *testing.T) *csPair {
     ready <- true
     fd, err := l.Accept()
     assert.Nil(t, err)
-    handlers := S3Handler(os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_KEY_ID"))
+    access_key := os.Getenv("AWS_ACCESS_KEY_ID")
+    userPlan, err := planForUser(access_key)
+    assert.Nil(t, err)
+    handlers, err := S3Handler(access_key, os.Getenv("AWS_SECRET_KEY_ID"), userPlan)
+    assert.Nil(t, err)
     server = sftp.NewRequestServer(fd, handlers)
     server.Serve()
   }()
@@ -1,8 +1,12 @@
 package main
 
 import (
+  "strconv"
+  "time"
+
   "github.com/aws/aws-sdk-go/aws"
   "github.com/aws/aws-sdk-go/aws/credentials"
+  "github.com/aws/aws-sdk-go/aws/request"
   "github.com/aws/aws-sdk-go/aws/session"
   "github.com/aws/aws-sdk-go/service/s3"
 )
@@ -12,7 +16,29 @@ func s3Client(access_key_id, secret_access_key string) (*s3.S3) {
   creds := credentials.NewStaticCredentialsFromCreds(value)
   sess, _ := session.NewSession(&aws.Config{ Region: aws.String("us-east-1") })
   client := s3.New(sess, &aws.Config{Credentials: creds})
+  client.Handlers.Validate.PushFrontNamed(request.NamedHandler{
+    Name: "s3tp.tracing",
+    Fn: startS3Span,
+  })
+  client.Handlers.Complete.PushBackNamed(request.NamedHandler{
+    Name: "s3tp.metrics",
+    Fn: observeS3Request,
+  })
+  client.Handlers.Complete.PushBackNamed(request.NamedHandler{
+    Name: "s3tp.tracing",
+    Fn: endS3Span,
+  })
 
   return client
 }
 
+// Runs once per API call after the last retry
+func observeS3Request(r *request.Request) {
+  status := "error"
+  if r.HTTPResponse != nil {
+    status = strconv.Itoa(r.HTTPResponse.StatusCode)
+  }
+
+  s3Requests.WithLabelValues(r.Operation.Name, status).Inc()
+  s3RequestDuration.WithLabelValues(r.Operation.Name).Observe(time.Since(r.Time).Seconds())
+}
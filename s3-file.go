@@ -1,16 +1,21 @@
 package main
 
 import (
-  "errors"
+  "context"
+  "crypto/sha256"
+  "encoding/hex"
+  "hash"
   "io"
   "os"
   "runtime/debug"
   "strconv"
   "sync"
+  "sync/atomic"
   "syscall"
   "time"
 
-  "github.com/rlmcpherson/s3gof3r"
+  "github.com/aws/aws-sdk-go/service/s3"
+  "go.opentelemetry.io/otel/trace"
 )
 
 const(
@@ -45,19 +50,13 @@ func setFromENV(env string, variable *int, defaultValue int) {
 func init() {
   setFromENV("CONCURRRENCY", &concurrency, 2)
   setFromENV("INITIAL_PART_SIZE_MB", &initialPartSizeMB, 5)
-  setFromENV("FILE_SIZE_LIMIT_MB", &fileSizeLimitMB, 5000)
+  setFromENV("FILE_SIZE_LIMIT_MB", &fileSizeLimitMB, int(maxObjectSize / mb))
 
   initialPartSizeBytes = int64(initialPartSizeMB) * mb
   fileSizeLimitBytes = int64(fileSizeLimitMB) * mb
-}
-
-var gof3rConfig = &s3gof3r.Config{
-  Concurrency: concurrency,
-  PartSize: 5 * mb, // initialPartSizseBytes
-  NTry: 10,
-  Md5Check: false,
-  Scheme: "https",
-  Client: s3gof3r.ClientWithTimeout(5 * time.Second),
+  if fileSizeLimitBytes <= 0 || fileSizeLimitBytes > maxObjectSize {
+    fileSizeLimitBytes = maxObjectSize
+  }
 }
 
 type orderedS3Reader struct {
@@ -71,8 +70,12 @@ type orderedS3Writer struct {
   nextOffset int64
   writeBuffer map[int64]*[]byte
   writtenBytesCount int64
-  streamingWriter io.WriteCloser
+  streamingWriter *multipartWriter
+  uploadSpan trace.Span // lasts as long as streamingWriter
+  modtimeChanged bool // by a SETSTAT after the upload's metadata was sent
   writeBufferLock sync.RWMutex
+  // SHA-256 of everything written, nil when resuming an earlier upload
+  checksum hash.Hash
 }
 
 // Implements os.FileInfo, Reader and Writer interfaces.
@@ -86,7 +89,10 @@ type s3File struct {
   contentLock sync.RWMutex
   bucket      string
   key         string
+  versionID   string // set when reading an older version, see versions.go
   size        int64
+  archived    bool // in Glacier and not restored, see check_archived
+  openedAt    time.Time
   orderedS3Writer
   orderedS3Reader
   *s3fs
@@ -106,6 +112,10 @@ func (f *s3File) Mode() os.FileMode {
   if f.symlink != "" {
     ret = os.FileMode(0777) | os.ModeSymlink
   }
+  // can be overwritten but not read
+  if f.archived {
+    ret = os.FileMode(0200)
+  }
 
   return ret
 }
@@ -160,6 +170,21 @@ func (f *s3File) notifyWaiting(offset int64) {
 }
 
 func (f *s3File) ReadAt(buffer []byte, offset int64) (int, error) {
+  if err := f.reserve_transfer(len(buffer)); err != nil {
+    return 0, err
+  }
+
+  n, err := f.readAt(buffer, offset)
+  f.refund_transfer(len(buffer) - n)
+
+  // charged for what was actually read, short reads near the end of a file
+  // shouldn't use up the user's allowance
+  f.throttle.waitRead(n)
+
+  return n, err
+}
+
+func (f *s3File) readAt(buffer []byte, offset int64) (int, error) {
   f.readBufferLock.Lock()
   defer f.readBufferLock.Unlock()
 
@@ -172,6 +197,8 @@ func (f *s3File) ReadAt(buffer []byte, offset int64) (int, error) {
 
   // update our position
   f.readBytesCount += int64(n)
+  atomic.AddInt64(&f.bytesRead, int64(n))
+  transferredBytes.WithLabelValues("read").Add(float64(n))
 
   // let the next guy know
   f.notifyWaiting(f.readBytesCount)
@@ -180,20 +207,52 @@ func (f *s3File) ReadAt(buffer []byte, offset int64) (int, error) {
 }
 
 func (f *s3File) WriteAt(data []byte, offset int64) (int, error) {
-  f.writeBufferLock.Lock()
+  limit := f.plan.maxFileSizeBytes
+  if limit <= 0 || limit > maxObjectSize {
+    limit = maxObjectSize
+  }
 
-  if offset > fileSizeLimitBytes {
-    f.writeBufferLock.Unlock()
-    return 0, errors.New("Max upload size exceeded")
+  if offset + int64(len(data)) > limit {
+    return 0, errMaxFileSizeExceeded
   }
 
+  if err := f.reserve_transfer(len(data)); err != nil {
+    return 0, err
+  }
+
+  f.throttle.waitWrite(len(data))
+
+  n, err := f.writeAt(data, offset)
+  atomic.AddInt64(&f.bytesWritten, int64(n))
+  transferredBytes.WithLabelValues("write").Add(float64(n))
+
+  return n, err
+}
+
+func (f *s3File) writeAt(data []byte, offset int64) (int, error) {
+  n := len(data)
+  f.writeBufferLock.Lock()
+
   if f.writeBuffer == nil { // somebody's first time?
     f.writeBuffer = make(map[int64]*[]byte)
   }
 
+  // Everything before nextOffset has gone to S3 and can't be checked, a
+  // resumed upload continues from there and anything else is a client bug
+  if offset < f.nextOffset {
+    f.writeBufferLock.Unlock()
+    return 0, errOverlappingWrite
+  }
+
   if offset == f.nextOffset { // we have a hit!
+    if _, err := f.streamingWriter.Write(data); err != nil {
+      f.writeBufferLock.Unlock()
+      return 0, err
+    }
     f.writtenBytesCount += int64(len(data))
-    f.streamingWriter.Write(data)
+    if f.checksum != nil {
+      f.checksum.Write(data)
+    }
 
     delete(f.writeBuffer, offset) // if we recursed to get here this could happen
 
@@ -208,16 +267,16 @@ func (f *s3File) WriteAt(data []byte, offset int64) (int, error) {
     // someone else's problem
     f.writeBufferLock.Unlock()
     // Recurse on our data structure
-    f.WriteAt(*value, f.nextOffset)
+    f.writeAt(*value, f.nextOffset)
 
   } else {
     f.writeBufferLock.Unlock()
   }
 
-  return len(data), nil
+  return n, nil
 }
 
-func (f *s3File) OpenStreamingReader(accessKey, secretKey string) (error) {
+func (f *s3File) OpenStreamingReader(ctx context.Context) (error) {
   f.readBufferLock.Lock()
   defer f.readBufferLock.Unlock()
 
@@ -225,24 +284,20 @@ func (f *s3File) OpenStreamingReader(accessKey, secretKey string) (error) {
     return nil
   }
 
-  keys := s3gof3r.Keys{AccessKey: accessKey, SecretKey: secretKey}
-
-  s3 := s3gof3r.New("", keys)
-  b := s3.Bucket(f.bucket)
-
-  r, _, err := b.GetReader(f.key, gof3rConfig)
-
+  env, err := f.open_envelope(ctx)
   if err != nil {
     return err
   }
 
   f.readWaiters = make(map[int64] chan struct{})
-  f.streamingReader = r
+  f.streamingReader = newReadAheadReader(ctx, f.S3, f.bucket, f.key, f.version(), f.size, f.encryption_for(f.bucket), env)
 
   return nil
 }
 
-func (f *s3File) OpenStreamingWriter(accessKey, secretKey string) (io.WriteCloser, error) {
+// Start a multipart upload for the file, or when resume is set and this user
+// has an interrupted upload for the same path, carry on from where it stopped.
+func (f *s3File) OpenStreamingWriter(ctx context.Context, resume bool) (*multipartWriter, error) {
   f.writeBufferLock.Lock()
   defer f.writeBufferLock.Unlock()
 
@@ -250,22 +305,129 @@ func (f *s3File) OpenStreamingWriter(accessKey, secretKey string) (io.WriteClose
     return f.streamingWriter, nil
   }
 
-  keys := s3gof3r.Keys{AccessKey: accessKey, SecretKey: secretKey}
+  encryption := f.encryption_for(f.bucket)
 
-  s3 := s3gof3r.New("", keys)
-  b := s3.Bucket(f.bucket)
-
-  w, err := b.PutWriter(f.key, nil, gof3rConfig)
+  // the data key isn't kept anywhere until the object is complete, so there's
+  // no picking up an encrypted upload where it left off
+  if encryption.client_side() {
+    resume = false
+  }
 
+  state, err := loadUploadState(f.accessKey, f.bucket, f.key)
   if err != nil {
     return nil, err
   }
 
+  if state != nil && !resume {
+    abortMultipartUpload(f.S3, f.bucket, f.key, state.uploadID)
+    state.delete()
+    state = nil
+  }
+
+  var w *multipartWriter
+  ctx, span := f.start_upload_span(ctx, f.bucket, f.key)
+
+  if state != nil {
+    w = resumeMultipartWriter(ctx, f.S3, f.bucket, f.key, state.uploadID, state.parts, state.size)
+    f.nextOffset = state.size
+  } else {
+    w = newMultipartWriter(ctx, f.S3, f.bucket, f.key)
+    state = &uploadState{accessKey: f.accessKey, bucket: f.bucket, key: f.key}
+    f.checksum = sha256.New()
+  }
+
+  w.partSize = basePartSize(f.size)
+  w.encryption = encryption
+  w.metadata = f.upload_metadata()
+  w.contentType = contentTypeFor(f.key)
+  w.tagging = f.tagging_for(f.bucket, f.key)
+  w.storageClass = f.storage_for(f.bucket).class()
+
+  // Recorded as soon as there's an upload, even one that can't be resumed,
+  // so the janitor knows it's ours to clean up if we never get to
+  w.onStart = func() {
+    state.uploadID = w.uploadID
+
+    if err := state.save(); err != nil {
+      f.log.Error("could not save upload state", "bucket", f.bucket, "key", f.key, "error", err)
+    }
+  }
+
+  if encryption.client_side() {
+    if err := w.encryptClientSide(ctx); err != nil {
+      endSpan(span, err)
+      return nil, err
+    }
+  } else {
+    w.onCommit = func(parts []*s3.CompletedPart, size int64) {
+      state.uploadID = w.uploadID
+      state.parts = parts
+      state.size = size
+
+      if err := state.save(); err != nil {
+        f.log.Error("could not save upload state", "bucket", f.bucket, "key", f.key, "error", err)
+      }
+    }
+  }
+
   f.streamingWriter = w
+  f.uploadSpan = span
+  f.s3fs.track_writer(f)
+  f.invalidate_path(f.name)
 
   return w, nil
 }
 
+// Abort throws away a write that the client never closed. If some parts made
+// it to S3 the upload is kept so the client can resume it later, the janitor
+// cleans it up if they never come back.
+func (f *s3File) Abort() (error) {
+  f.writeBufferLock.Lock()
+  defer f.writeBufferLock.Unlock()
+
+  if f.streamingWriter == nil {
+    return nil
+  }
+
+  w := f.streamingWriter
+  f.streamingWriter = nil
+  f.invalidate_path(f.name)
+
+  f.persist_event(&event{Category: "WRITE", Bucket: f.bucket, Key: f.key, Size: f.writtenBytesCount, StartedAt: f.openedAt}, errUploadInterrupted)
+
+  w.Suspend()
+  endSpan(f.uploadSpan, errUploadInterrupted)
+
+  if w.Committed() > 0 && w.error() == nil && w.sealer == nil {
+    f.log.Info("left upload resumable", "bucket", f.bucket, "key", f.key, "committed_bytes", w.Committed())
+    return nil
+  }
+
+  f.log.Info("aborting unfinished upload", "bucket", f.bucket, "key", f.key)
+  deleteUploadState(f.accessKey, f.bucket, f.key, w.uploadID)
+
+  return w.Abort()
+}
+
+func (f *s3File) uploadNotification(etag string) (*uploadNotification) {
+  n := &uploadNotification{
+    Event: "upload.completed",
+    AccessKey: f.accessKey,
+    SessionID: f.sessionID,
+    Bucket: f.bucket,
+    Key: f.key,
+    Size: f.nextOffset,
+    ETag: etag,
+    CompletedAt: time.Now(),
+  }
+
+  if f.checksum != nil {
+    n.SHA256 = hex.EncodeToString(f.checksum.Sum(nil))
+  }
+
+  return n
+}
+
 func (f *s3File) Close() (error) {
   var err error
 
@@ -273,13 +435,28 @@ func (f *s3File) Close() (error) {
     f.writeBufferLock.Lock()
     defer f.writeBufferLock.Unlock()
 
-    err = f.streamingWriter.Close()
+    w := f.streamingWriter
+    err = w.Close()
+    endSpan(f.uploadSpan, err)
     f.streamingWriter = nil
+    f.s3fs.untrack_writer(f)
+    f.invalidate_path(f.name)
+    deleteUploadState(f.accessKey, f.bucket, f.key, w.uploadID)
     debug.FreeOSMemory()
 
-    if f.writtenBytesCount > 0 {
-      go persist_event(f.sessionID, f.accessKey, "WRITE", f.writtenBytesCount)
+    if err == nil && f.modtimeChanged {
+      if etag, err := f.replace_modtime(f.ctx, f.bucket, f.key, f.modtime); err != nil {
+        f.log.Error("could not record mtime", "bucket", f.bucket, "key", f.key, "error", err)
+      } else {
+        w.etag = etag
+      }
     }
+
+    if err == nil && f.notifier != nil {
+      f.notifier.notify(f.uploadNotification(w.etag))
+    }
+
+    f.persist_event(&event{Category: "WRITE", Bucket: f.bucket, Key: f.key, Size: f.writtenBytesCount, StartedAt: f.openedAt}, err)
   }
 
   if f.streamingReader != nil {
@@ -288,11 +465,10 @@ func (f *s3File) Close() (error) {
 
     err = f.streamingReader.Close()
     f.streamingReader = nil
+    f.s3fs.untrack_reader(f)
     debug.FreeOSMemory()
 
-    if f.readBytesCount > 0 {
-      go persist_event(f.sessionID, f.accessKey, "READ", f.readBytesCount)
-    }
+    f.persist_event(&event{Category: "READ", Bucket: f.bucket, Key: f.key, Size: f.readBytesCount, StartedAt: f.openedAt}, err)
   }
 
   if err != nil {
@@ -0,0 +1,160 @@
+package main
+
+import (
+  "errors"
+  "net/http"
+  "sort"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+var errSessionNotFound = errors.New("session not found")
+
+// Every SFTP session currently being served, so operators can see who is
+// connected and hang up on them.
+type sessionRegistry struct {
+  sessions map[string]*liveSession
+  lock sync.RWMutex
+}
+
+type liveSession struct {
+  fs *s3fs
+  watchdog *sessionWatchdog
+}
+
+var sessions = &sessionRegistry{sessions: make(map[string]*liveSession)}
+
+func (r *sessionRegistry) add(fs *s3fs, watchdog *sessionWatchdog) {
+  r.lock.Lock()
+  defer r.lock.Unlock()
+
+  r.sessions[fs.sessionID.String()] = &liveSession{fs, watchdog}
+}
+
+func (r *sessionRegistry) remove(fs *s3fs) {
+  r.lock.Lock()
+  defer r.lock.Unlock()
+
+  delete(r.sessions, fs.sessionID.String())
+}
+
+func (r *sessionRegistry) get(id string) (*liveSession, error) {
+  r.lock.RLock()
+  defer r.lock.RUnlock()
+
+  s, ok := r.sessions[id]
+  if !ok {
+    return nil, errSessionNotFound
+  }
+
+  return s, nil
+}
+
+// Oldest first
+func (r *sessionRegistry) list() ([]*liveSession) {
+  r.lock.RLock()
+  list := make([]*liveSession, 0, len(r.sessions))
+  for _, s := range r.sessions {
+    list = append(list, s)
+  }
+  r.lock.RUnlock()
+
+  sort.Slice(list, func(i, j int) bool {
+    return list[i].fs.startedAt.Before(list[j].fs.startedAt)
+  })
+
+  return list
+}
+
+// Closing the connection ends every session on it, the client is told why
+// on stderr first.
+func (s *liveSession) kill() {
+  s.watchdog.disconnect("admin", "session terminated by an administrator")
+}
+
+type sessionInfo struct {
+  SessionID string `json:"session_id"`
+  AccessKey string `json:"access_key_id"`
+  RemoteAddr string `json:"remote_addr"`
+  ClientVersion string `json:"client_version"`
+  StartedAt time.Time `json:"started_at"`
+  BytesRead int64 `json:"bytes_read"`
+  BytesWritten int64 `json:"bytes_written"`
+  OpenFiles []openFileInfo `json:"open_files"`
+}
+
+type openFileInfo struct {
+  Path string `json:"path"`
+  Mode string `json:"mode"`
+  OpenedAt time.Time `json:"opened_at"`
+}
+
+func (s *liveSession) info() (*sessionInfo) {
+  fs := s.fs
+
+  info := &sessionInfo{
+    SessionID: fs.sessionID.String(),
+    AccessKey: fs.accessKey,
+    RemoteAddr: fs.remoteAddr,
+    ClientVersion: fs.clientVersion,
+    StartedAt: fs.startedAt,
+    BytesRead: atomic.LoadInt64(&fs.bytesRead),
+    BytesWritten: atomic.LoadInt64(&fs.bytesWritten),
+    OpenFiles: []openFileInfo{},
+  }
+
+  fs.filesLock.Lock()
+  for f, _ := range fs.openReaders {
+    info.OpenFiles = append(info.OpenFiles, openFileInfo{f.name, "read", f.openedAt})
+  }
+  for f, _ := range fs.openWriters {
+    info.OpenFiles = append(info.OpenFiles, openFileInfo{f.name, "write", f.openedAt})
+  }
+  fs.filesLock.Unlock()
+
+  sort.Slice(info.OpenFiles, func(i, j int) bool {
+    return info.OpenFiles[i].OpenedAt.Before(info.OpenFiles[j].OpenedAt)
+  })
+
+  return info
+}
+
+// GET /sessions lists live sessions, access_key_id narrows it to one user
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != "GET" {
+    writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+
+  accessKey := r.URL.Query().Get("access_key_id")
+  list := []*sessionInfo{}
+
+  for _, s := range sessions.list() {
+    if accessKey == "" || s.fs.accessKey == accessKey {
+      list = append(list, s.info())
+    }
+  }
+
+  writeJSON(w, http.StatusOK, map[string]interface{}{"data": list})
+}
+
+// GET /sessions/<id> inspects a session, DELETE /sessions/<id> kills it
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+  s, err := sessions.get(strings.TrimPrefix(r.URL.Path, "/sessions/"))
+  if err != nil {
+    writeAPIError(w, http.StatusNotFound, err.Error())
+    return
+  }
+
+  switch r.Method {
+  case "GET":
+    writeJSON(w, http.StatusOK, s.info())
+  case "DELETE":
+    s.kill()
+    w.WriteHeader(http.StatusNoContent)
+  default:
+    writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+  }
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "os"
+  "strings"
+
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/awserr"
+  "github.com/aws/aws-sdk-go/service/s3"
+)
+
+var (
+  errArchived = errors.New("Object is archived and has to be restored before it can be read")
+  errRestoreStarted = errors.New("Object is archived, a restore has been requested, try again once it's done")
+  errRestoreInProgress = errors.New("Object is archived and being restored, try again once it's done")
+)
+
+var storageClasses = map[string]bool{
+  "STANDARD": true,
+  "REDUCED_REDUNDANCY": true,
+  "STANDARD_IA": true,
+  "ONEZONE_IA": true,
+  "INTELLIGENT_TIERING": true,
+  "GLACIER_IR": true,
+  "GLACIER": true,
+  "DEEP_ARCHIVE": true,
+}
+
+// Objects in these classes have to be restored before they can be read
+var archiveClasses = map[string]bool{
+  "GLACIER": true,
+  "DEEP_ARCHIVE": true,
+}
+
+var restoreTiers = map[string]bool{
+  s3.TierStandard: true,
+  s3.TierBulk: true,
+  s3.TierExpedited: true,
+}
+
+// What uploads to a mount are stored as and what reading archived objects
+// there does
+type storageSettings struct {
+  storageClass string // empty leaves it to S3, which means STANDARD
+  restoreOnRead bool
+  restoreDays int64
+  restoreTier string
+}
+
+// Server-wide defaults for users and buckets without settings of their own
+var defaultStorage *storageSettings
+
+func loadDefaultStorage() (error) {
+  var restoreOnRead, restoreDays int
+  setFromENV("RESTORE_ON_READ", &restoreOnRead, 0)
+  setFromENV("RESTORE_DAYS", &restoreDays, 1)
+
+  tier := os.Getenv("RESTORE_TIER")
+  if tier == "" {
+    tier = s3.TierStandard
+  }
+
+  var err error
+  defaultStorage, err = newStorageSettings(os.Getenv("STORAGE_CLASS"), restoreOnRead != 0, int64(restoreDays), tier)
+
+  return err
+}
+
+func newStorageSettings(storageClass string, restoreOnRead bool, restoreDays int64, restoreTier string) (*storageSettings, error) {
+  storageClass = strings.ToUpper(storageClass)
+
+  if storageClass != "" && !storageClasses[storageClass] {
+    return nil, fmt.Errorf("unknown storage class %q", storageClass)
+  }
+  if !restoreTiers[restoreTier] {
+    return nil, fmt.Errorf("unknown restore tier %q", restoreTier)
+  }
+  if restoreDays < 1 {
+    return nil, fmt.Errorf("restores have to last at least a day")
+  }
+
+  return &storageSettings{
+    storageClass: storageClass,
+    restoreOnRead: restoreOnRead,
+    restoreDays: restoreDays,
+    restoreTier: restoreTier,
+  }, nil
+}
+
+// The user's settings keyed by bucket, "" applies to every bucket they don't
+// have specific settings for
+func loadStorageSettings(accessKey string) (map[string]*storageSettings, error) {
+  settings := make(map[string]*storageSettings)
+
+  if db == nil {
+    return settings, nil
+  }
+
+  var query = `
+    SELECT bucket, storage_class, restore_on_read, restore_days, restore_tier
+    FROM storage_settings
+    WHERE access_key_id = $1;
+  `
+
+  rows, err := db.Query(query, accessKey)
+  if err != nil {
+    return settings, err
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    var bucket, storageClass, restoreTier string
+    var restoreOnRead bool
+    var restoreDays int64
+
+    if err := rows.Scan(&bucket, &storageClass, &restoreOnRead, &restoreDays, &restoreTier); err != nil {
+      return settings, err
+    }
+
+    s, err := newStorageSettings(storageClass, restoreOnRead, restoreDays, restoreTier)
+    if err != nil {
+      return settings, fmt.Errorf("storage settings for %q: %v", bucket, err)
+    }
+    settings[bucket] = s
+  }
+
+  return settings, rows.Err()
+}
+
+func (fs *s3fs) storage_for(bucket string) (*storageSettings) {
+  if s, ok := fs.storage[bucket]; ok {
+    return s
+  }
+
+  if s, ok := fs.storage[""]; ok {
+    return s
+  }
+
+  return defaultStorage
+}
+
+// nil leaves it to S3
+func (s *storageSettings) class() (*string) {
+  if s == nil || s.storageClass == "" {
+    return nil
+  }
+
+  return aws.String(s.storageClass)
+}
+
+// Whether an object can't be read as it is. HeadObject tells us about
+// restores, listings only have the class.
+func isArchived(storageClass, restore *string) (bool) {
+  if !archiveClasses[aws.StringValue(storageClass)] {
+    return false
+  }
+
+  return !strings.Contains(aws.StringValue(restore), `ongoing-request="false"`)
+}
+
+// Listings and the metadata cache can be out of date about restores, so an
+// archived file is looked up again before giving up on it. When the mount
+// restores on read, asking for an archived file starts a restore.
+func (f *s3File) check_archived(ctx context.Context) (error) {
+  if !f.archived {
+    return nil
+  }
+
+  input := &s3.HeadObjectInput{
+    Bucket: aws.String(f.bucket),
+    Key: aws.String(f.key),
+    VersionId: f.version(),
+  }
+  f.encryption_for(f.bucket).applyToHead(input)
+
+  output, err := f.HeadObjectWithContext(ctx, input)
+  if err != nil {
+    return err
+  }
+
+  if !isArchived(output.StorageClass, output.Restore) {
+    f.archived = false
+    return nil
+  }
+
+  if strings.Contains(aws.StringValue(output.Restore), `ongoing-request="true"`) {
+    return errRestoreInProgress
+  }
+
+  settings := f.storage_for(f.bucket)
+  if settings == nil || !settings.restoreOnRead {
+    return errArchived
+  }
+
+  _, err = f.RestoreObjectWithContext(ctx, &s3.RestoreObjectInput{
+    Bucket: aws.String(f.bucket),
+    Key: aws.String(f.key),
+    VersionId: f.version(),
+    RestoreRequest: &s3.RestoreRequest{
+      Days: aws.Int64(settings.restoreDays),
+      GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(settings.restoreTier)},
+    },
+  })
+
+  if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "RestoreAlreadyInProgress" {
+    return errRestoreInProgress
+  }
+  if err != nil {
+    return err
+  }
+
+  f.log.Info("started restore", "bucket", f.bucket, "key", f.key, "tier", settings.restoreTier)
+
+  return errRestoreStarted
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+  "context"
+  "os"
+  "testing"
+  "time"
+
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestStorageSettings(t *testing.T) {
+  s, err := newStorageSettings("standard_ia", false, 1, "Standard")
+  assert.Nil(t, err)
+  assert.Equal(t, "STANDARD_IA", aws.StringValue(s.class()))
+
+  s, _ = newStorageSettings("", true, 3, "Bulk")
+  assert.Nil(t, s.class())
+  assert.Nil(t, (*storageSettings)(nil).class())
+
+  _, err = newStorageSettings("COLD", false, 1, "Standard")
+  assert.NotNil(t, err)
+  _, err = newStorageSettings("GLACIER", true, 1, "Fast")
+  assert.NotNil(t, err)
+  _, err = newStorageSettings("GLACIER", true, 0, "Standard")
+  assert.NotNil(t, err)
+}
+
+func TestStorageForBucket(t *testing.T) {
+  everywhere := &storageSettings{storageClass: "INTELLIGENT_TIERING"}
+  archive := &storageSettings{storageClass: "DEEP_ARCHIVE"}
+
+  fs := &s3fs{storage: map[string]*storageSettings{"": everywhere, "archive": archive}}
+  assert.Equal(t, archive, fs.storage_for("archive"))
+  assert.Equal(t, everywhere, fs.storage_for("photos"))
+  assert.Equal(t, defaultStorage, (&s3fs{}).storage_for("photos"))
+}
+
+func TestArchivedObjects(t *testing.T) {
+  assert.False(t, isArchived(aws.String("STANDARD_IA"), nil))
+  assert.False(t, isArchived(aws.String("GLACIER_IR"), nil))
+  assert.True(t, isArchived(aws.String("GLACIER"), nil))
+  assert.True(t, isArchived(aws.String("DEEP_ARCHIVE"), aws.String(`ongoing-request="true"`)))
+  assert.False(t, isArchived(aws.String("GLACIER"), aws.String(`ongoing-request="false", expiry-date="Fri, 20 Apr 2018 00:00:00 GMT"`)))
+
+  f := &s3File{name: "old.tar", archived: true}
+  assert.Equal(t, os.FileMode(0200), f.Mode())
+  assert.Equal(t, os.FileMode(0644), (&s3File{name: "new.tar"}).Mode())
+
+  // readable files don't go back to S3
+  assert.Nil(t, (&s3File{}).check_archived(context.Background()))
+}
+
+func TestMetadataCacheKeepsArchived(t *testing.T) {
+  fs := &s3fs{metadata: newMetadataCache(time.Minute, 10)}
+
+  fs.cache_stat("/archive/old.tar", &s3File{name: "/archive/old.tar", bucket: "archive", key: "old.tar", archived: true})
+  assert.True(t, fs.cached_stat("/archive/old.tar").archived)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+  "sync"
+  "time"
+)
+
+var (
+  globalReadBytesPerSecond int
+  globalWriteBytesPerSecond int
+  userReadBytesPerSecond int
+  userWriteBytesPerSecond int
+)
+
+func init() {
+  setFromENV("GLOBAL_READ_BYTES_PER_SECOND", &globalReadBytesPerSecond, 0)
+  setFromENV("GLOBAL_WRITE_BYTES_PER_SECOND", &globalWriteBytesPerSecond, 0)
+  setFromENV("USER_READ_BYTES_PER_SECOND", &userReadBytesPerSecond, 0)
+  setFromENV("USER_WRITE_BYTES_PER_SECOND", &userWriteBytesPerSecond, 0)
+
+  globalThrottle.read.setRate(int64(globalReadBytesPerSecond))
+  globalThrottle.write.setRate(int64(globalWriteBytesPerSecond))
+}
+
+// A token bucket measured in bytes. Callers reserve the bytes they're about
+// to move and sleep until the bucket can pay for them, tokens may go negative
+// so reservations are served in the order they were made. That keeps
+// concurrent files sharing a bucket roughly fair.
+type tokenBucket struct {
+  rate float64 // bytes per second, 0 is unlimited
+  tokens float64
+  last time.Time
+  lock sync.Mutex
+}
+
+func newTokenBucket(bytesPerSecond int64) (*tokenBucket) {
+  b := &tokenBucket{}
+  b.setRate(bytesPerSecond)
+
+  return b
+}
+
+// Change the rate, a bucket that was unlimited starts out full. Otherwise the
+// tokens carry over so that a new session can't refill a user's bucket.
+func (b *tokenBucket) setRate(bytesPerSecond int64) {
+  b.lock.Lock()
+  defer b.lock.Unlock()
+
+  rate := float64(bytesPerSecond)
+  if rate == b.rate {
+    return
+  }
+
+  now := time.Now()
+
+  if b.rate <= 0 {
+    b.tokens = rate
+  } else {
+    b.tokens += now.Sub(b.last).Seconds() * b.rate
+    if b.tokens > rate {
+      b.tokens = rate
+    }
+  }
+
+  b.rate = rate
+  b.last = now
+}
+
+// How long the caller has to wait before moving n bytes
+func (b *tokenBucket) reserve(n int) (time.Duration) {
+  b.lock.Lock()
+  defer b.lock.Unlock()
+
+  if b.rate <= 0 {
+    return 0
+  }
+
+  now := time.Now()
+
+  // refill, holding at most one second's worth
+  b.tokens += now.Sub(b.last).Seconds() * b.rate
+  if b.tokens > b.rate {
+    b.tokens = b.rate
+  }
+  b.last = now
+
+  b.tokens -= float64(n)
+  if b.tokens >= 0 {
+    return 0
+  }
+
+  return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Wait until every bucket allows n more bytes
+func throttleWait(n int, buckets ...*tokenBucket) {
+  var wait time.Duration
+
+  for _, b := range buckets {
+    if d := b.reserve(n); d > wait {
+      wait = d
+    }
+  }
+
+  if wait > 0 {
+    time.Sleep(wait)
+  }
+}
+
+type throttle struct {
+  read *tokenBucket
+  write *tokenBucket
+}
+
+var globalThrottle = &throttle{read: newTokenBucket(0), write: newTokenBucket(0)}
+
+// Users share one throttle across all of their sessions and files
+var userThrottles = make(map[string]*throttle)
+var userThrottlesLock sync.Mutex
+
+func throttleForUser(accessKey string, p *plan) (*throttle) {
+  userThrottlesLock.Lock()
+  defer userThrottlesLock.Unlock()
+
+  t, ok := userThrottles[accessKey]
+  if !ok {
+    t = &throttle{
+      read: newTokenBucket(p.readBytesPerSecond),
+      write: newTokenBucket(p.writeBytesPerSecond),
+    }
+    userThrottles[accessKey] = t
+  } else {
+    t.read.setRate(p.readBytesPerSecond)
+    t.write.setRate(p.writeBytesPerSecond)
+  }
+
+  return t
+}
+
+func (t *throttle) waitRead(n int) {
+  throttleWait(n, t.read, globalThrottle.read)
+}
+
+func (t *throttle) waitWrite(n int) {
+  throttleWait(n, t.write, globalThrottle.write)
+}
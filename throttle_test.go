@@ -0,0 +1,45 @@
+package main
+
+import (
+  "testing"
+  "time"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucketUnlimited(t *testing.T) {
+  b := newTokenBucket(0)
+
+  assert.Equal(t, time.Duration(0), b.reserve(100 * int(mb)))
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+  b := newTokenBucket(1000)
+
+  // a full second's worth is available straight away
+  assert.Equal(t, time.Duration(0), b.reserve(1000))
+
+  // after that callers queue up behind each other
+  first := b.reserve(500)
+  second := b.reserve(500)
+  assert.InDelta(t, float64(500 * time.Millisecond), float64(first), float64(10 * time.Millisecond))
+  assert.InDelta(t, float64(time.Second), float64(second), float64(10 * time.Millisecond))
+}
+
+func TestTokenBucketSetRateKeepsTokens(t *testing.T) {
+  b := newTokenBucket(1000)
+  b.reserve(1000)
+
+  // a new session for the same user doesn't refill the bucket
+  b.setRate(1000)
+  assert.InDelta(t, float64(500 * time.Millisecond), float64(b.reserve(500)), float64(10 * time.Millisecond))
+
+  // lowering the rate doesn't hand out tokens either
+  b.setRate(500)
+  assert.True(t, b.reserve(1) > 0)
+
+  // going from unlimited starts full
+  u := newTokenBucket(0)
+  u.setRate(1000)
+  assert.Equal(t, time.Duration(0), u.reserve(1000))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+  "context"
+  "os"
+
+  "github.com/aws/aws-sdk-go/aws/request"
+  "go.opentelemetry.io/otel"
+  "go.opentelemetry.io/otel/attribute"
+  "go.opentelemetry.io/otel/codes"
+  "go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+  "go.opentelemetry.io/otel/sdk/resource"
+  sdktrace "go.opentelemetry.io/otel/sdk/trace"
+  "go.opentelemetry.io/otel/trace"
+  "github.com/pkg/sftp"
+)
+
+// Spans go to the global provider, which does nothing until startTracing
+// installs an exporter.
+var tracer = otel.Tracer("github.com/blankenshipz/s3tp")
+
+var tracerProvider *sdktrace.TracerProvider
+
+// Tracing is on when an OTLP endpoint is configured, the exporter reads the
+// standard OTEL_EXPORTER_OTLP_* variables itself.
+func tracingEnabled() (bool) {
+  return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+func startTracing() (error) {
+  if !tracingEnabled() {
+    return nil
+  }
+
+  exporter, err := otlptracehttp.New(context.Background())
+  if err != nil {
+    return err
+  }
+
+  serviceName := os.Getenv("OTEL_SERVICE_NAME")
+  if serviceName == "" {
+    serviceName = "s3tp"
+  }
+
+  tracerProvider = sdktrace.NewTracerProvider(
+    sdktrace.WithBatcher(exporter),
+    sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+  )
+  otel.SetTracerProvider(tracerProvider)
+
+  return nil
+}
+
+// Flush whatever spans are still buffered
+func stopTracing() {
+  if tracerProvider == nil {
+    return
+  }
+
+  if err := tracerProvider.Shutdown(context.Background()); err != nil {
+    logger.Error("could not flush traces", "error", err)
+  }
+}
+
+func endSpan(span trace.Span, err error) {
+  if err != nil {
+    span.RecordError(err)
+    span.SetStatus(codes.Error, errorClass(err))
+  }
+
+  span.End()
+}
+
+// A span for one SFTP request, a child of the session's span
+func (fs *s3fs) start_span(r *sftp.Request) (context.Context, trace.Span) {
+  return tracer.Start(fs.ctx, "sftp." + r.Method, trace.WithAttributes(
+    attribute.String("s3tp.session_id", fs.sessionID.String()),
+    attribute.String("s3tp.access_key_id", fs.accessKey),
+    attribute.String("sftp.path", r.Filepath),
+  ))
+}
+
+// An upload outlives the Put request that opens it, so its parts are traced
+// under a span of its own that's linked to the request and ends with the upload
+func (fs *s3fs) start_upload_span(ctx context.Context, bucket, key string) (context.Context, trace.Span) {
+  return tracer.Start(fs.ctx, "sftp.upload", trace.WithLinks(trace.Link{SpanContext: trace.SpanContextFromContext(ctx)}), trace.WithAttributes(
+    attribute.String("s3tp.session_id", fs.sessionID.String()),
+    attribute.String("s3tp.access_key_id", fs.accessKey),
+    attribute.String("s3.bucket", bucket),
+    attribute.String("s3.key", key),
+  ))
+}
+
+// Request handlers so that every S3 call gets a span under whatever context
+// it was made with.
+func startS3Span(r *request.Request) {
+  ctx, _ := tracer.Start(r.Context(), "s3." + r.Operation.Name, trace.WithSpanKind(trace.SpanKindClient))
+  r.SetContext(ctx)
+}
+
+func endS3Span(r *request.Request) {
+  span := trace.SpanFromContext(r.Context())
+
+  if r.HTTPResponse != nil {
+    span.SetAttributes(attribute.Int("http.status_code", r.HTTPResponse.StatusCode))
+  }
+  if r.RetryCount > 0 {
+    span.SetAttributes(attribute.Int("aws.retry_count", r.RetryCount))
+  }
+
+  endSpan(span, r.Error)
+}
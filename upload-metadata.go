@@ -0,0 +1,254 @@
+package main
+
+import (
+  "context"
+  "encoding/binary"
+  "encoding/json"
+  "fmt"
+  "mime"
+  "net/http"
+  "net/url"
+  "os"
+  "path"
+  "strconv"
+  "strings"
+  "time"
+
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Which x-amz-meta-* headers uploads get, any of user, session, remote-ip
+// and mtime, or none
+var uploadMetadata map[string]bool
+
+func init() {
+  fields := "user,session,remote-ip,mtime"
+  if value, ok := os.LookupEnv("UPLOAD_METADATA"); ok {
+    fields = value
+  }
+
+  uploadMetadata = make(map[string]bool)
+  for _, field := range strings.Split(fields, ",") {
+    if field = strings.TrimSpace(field); field != "" && field != "none" {
+      uploadMetadata[field] = true
+    }
+  }
+}
+
+const (
+  uploadedByHeader = "S3tp-Uploaded-By"
+  sessionIDHeader = "S3tp-Session-Id"
+  remoteIPHeader = "S3tp-Remote-Ip"
+  // what rclone and others use for the original modification time
+  mtimeHeader = "Mtime"
+)
+
+// nil when the extension isn't one we know, S3 falls back to binary/octet-stream
+func contentTypeFor(key string) (*string) {
+  contentType := mime.TypeByExtension(strings.ToLower(path.Ext(key)))
+  if contentType == "" {
+    return nil
+  }
+
+  return aws.String(contentType)
+}
+
+func (f *s3File) upload_metadata() (map[string]*string) {
+  metadata := make(map[string]*string)
+
+  if uploadMetadata["user"] {
+    metadata[uploadedByHeader] = aws.String(f.accessKey)
+  }
+  if uploadMetadata["session"] {
+    metadata[sessionIDHeader] = aws.String(f.sessionID.String())
+  }
+  if uploadMetadata["remote-ip"] && f.remoteAddr != "" {
+    metadata[remoteIPHeader] = aws.String(f.remoteAddr)
+  }
+  if uploadMetadata["mtime"] && !f.modtime.IsZero() {
+    metadata[mtimeHeader] = aws.String(strconv.FormatInt(f.modtime.Unix(), 10))
+  }
+
+  return metadata
+}
+
+// Clients that preserve times, like OpenSSH's put -p and WinSCP, send the
+// mtime in a SETSTAT around closing the file rather than with the open. It's
+// recorded the same way, nothing else a SETSTAT can change is supported.
+func (fs *s3fs) setstat(ctx context.Context, p string, attrs []byte) (error) {
+  modtime := declaredModTime(attrs)
+  if modtime.IsZero() || binary.BigEndian.Uint32(attrs)&sshFileXferAttrSize != 0 {
+    return errUnsupported
+  }
+
+  bucket, key := bucket_parts_from_filepath(p)
+  if key == "" || parseVersionPath(p) != nil {
+    return errUnsupported
+  }
+
+  if !uploadMetadata["mtime"] {
+    return nil
+  }
+
+  // still being written, the mtime goes out with the upload
+  if f := fs.open_writer(p); f != nil && f.set_modtime(modtime) {
+    return nil
+  }
+
+  _, err := fs.replace_modtime(ctx, bucket, key, modtime)
+  return err
+}
+
+// Set the mtime an upload still being written records, false when its
+// metadata has already gone to S3
+func (f *s3File) set_modtime(modtime time.Time) (bool) {
+  f.writeBufferLock.Lock()
+  defer f.writeBufferLock.Unlock()
+
+  f.modtime = modtime
+
+  w := f.streamingWriter
+  if w == nil {
+    return false
+  }
+  if w.uploadID != "" {
+    f.modtimeChanged = true
+    return true
+  }
+
+  w.metadata[mtimeHeader] = aws.String(strconv.FormatInt(modtime.Unix(), 10))
+  return true
+}
+
+// S3 metadata can't be changed in place, copy the object over itself with
+// everything but the mtime kept. Returns the copy's ETag, or the object's when
+// it already has that mtime and there's nothing to copy.
+func (fs *s3fs) replace_modtime(ctx context.Context, bucket, key string, modtime time.Time) (string, error) {
+  head := &s3.HeadObjectInput{
+    Bucket: aws.String(bucket),
+    Key: aws.String(key),
+  }
+  encryption := fs.encryption_for(bucket)
+  encryption.applyToHead(head)
+
+  output, err := fs.HeadObjectWithContext(ctx, head)
+  if err != nil {
+    return "", err
+  }
+
+  if aws.Int64Value(output.ContentLength) > maxCopySize {
+    return "", errUnsupported
+  }
+
+  mtime := strconv.FormatInt(modtime.Unix(), 10)
+
+  metadata := output.Metadata
+  if metadata == nil {
+    metadata = make(map[string]*string)
+  }
+  for k, v := range metadata {
+    if strings.EqualFold(k, mtimeHeader) {
+      if aws.StringValue(v) == mtime {
+        return aws.StringValue(output.ETag), nil
+      }
+      delete(metadata, k)
+    }
+  }
+  metadata[mtimeHeader] = aws.String(mtime)
+
+  input := &s3.CopyObjectInput{
+    Bucket: aws.String(bucket),
+    Key: aws.String(key),
+    CopySource: aws.String((&url.URL{Path: bucket + delimiter + key}).EscapedPath()),
+    MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+    Metadata: metadata,
+    ContentType: output.ContentType,
+    ContentEncoding: output.ContentEncoding,
+    ContentDisposition: output.ContentDisposition,
+    ContentLanguage: output.ContentLanguage,
+    CacheControl: output.CacheControl,
+    WebsiteRedirectLocation: output.WebsiteRedirectLocation,
+    StorageClass: output.StorageClass,
+  }
+  if expires, err := http.ParseTime(aws.StringValue(output.Expires)); err == nil {
+    input.Expires = &expires
+  }
+  encryption.applyToCopy(input, encryption)
+
+  copied, err := fs.CopyObjectWithContext(ctx, input, encryption.requestOptions()...)
+  if err != nil || copied.CopyObjectResult == nil {
+    return "", err
+  }
+
+  return aws.StringValue(copied.CopyObjectResult.ETag), nil
+}
+
+// Tags for objects uploaded to a bucket, or to every bucket when bucket is
+// empty, under a key prefix
+type taggingRule struct {
+  bucket string
+  prefix string
+  tags map[string]string
+}
+
+// The user's rules, least specific first
+func loadTaggingRules(accessKey string) ([]*taggingRule, error) {
+  if db == nil {
+    return nil, nil
+  }
+
+  var query = `
+    SELECT bucket, prefix, tags
+    FROM tagging_rules
+    WHERE access_key_id = $1
+    ORDER BY bucket != '', length(prefix), created_at;
+  `
+
+  rows, err := db.Query(query, accessKey)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  var rules []*taggingRule
+
+  for rows.Next() {
+    rule := &taggingRule{}
+    var tags []byte
+
+    if err := rows.Scan(&rule.bucket, &rule.prefix, &tags); err != nil {
+      return rules, err
+    }
+
+    if err := json.Unmarshal(tags, &rule.tags); err != nil {
+      return rules, fmt.Errorf("tags for %q must be a JSON object of strings: %v", rule.bucket + delimiter + rule.prefix, err)
+    }
+
+    rules = append(rules, rule)
+  }
+
+  return rules, rows.Err()
+}
+
+// The tags every matching rule sets, more specific rules win, encoded the way
+// S3 wants them on upload. nil when there are none.
+func (fs *s3fs) tagging_for(bucket, key string) (*string) {
+  tags := url.Values{}
+
+  for _, rule := range fs.taggingRules {
+    if (rule.bucket != "" && rule.bucket != bucket) || !strings.HasPrefix(key, rule.prefix) {
+      continue
+    }
+
+    for k, v := range rule.tags {
+      tags.Set(k, v)
+    }
+  }
+
+  if len(tags) == 0 {
+    return nil
+  }
+
+  return aws.String(tags.Encode())
+}
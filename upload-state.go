@@ -0,0 +1,305 @@
+package main
+
+import (
+  "crypto/sha256"
+  "database/sql"
+  "encoding/hex"
+  "encoding/json"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+
+  "github.com/aws/aws-sdk-go/service/s3"
+)
+
+// What we need to know to pick an interrupted upload back up: the S3
+// multipart UploadId, the parts that completed and how many bytes they hold.
+// Keyed by user and path so only the same user can resume it.
+type uploadState struct {
+  accessKey string
+  bucket string
+  key string
+  uploadID string
+  parts []*s3.CompletedPart
+  size int64
+}
+
+type uploadStatePart struct {
+  PartNumber int64 `json:"part_number"`
+  ETag string `json:"etag"`
+}
+
+// Upload state lives in Postgres, or in a directory of JSON files when the
+// server runs without a database.
+type uploadStateStore interface {
+  load(accessKey, bucket, key string) (*uploadState, error)
+  save(u *uploadState) error
+  delete(u *uploadState) error
+  // every upload recorded for the user, without their parts
+  list(accessKey string) ([]*uploadState, error)
+}
+
+var uploadStates uploadStateStore = &postgresUploadStates{}
+
+func loadUploadState(accessKey, bucket, key string) (*uploadState, error) {
+  return uploadStates.load(accessKey, bucket, key)
+}
+
+func (u *uploadState) save() (error) {
+  return uploadStates.save(u)
+}
+
+func (u *uploadState) delete() (error) {
+  return uploadStates.delete(u)
+}
+
+func deleteUploadState(accessKey, bucket, key, uploadID string) (error) {
+  u := &uploadState{accessKey: accessKey, bucket: bucket, key: key, uploadID: uploadID}
+
+  return u.delete()
+}
+
+func (u *uploadState) encodedParts() ([]byte, error) {
+  parts := make([]uploadStatePart, len(u.parts))
+  for i, p := range u.parts {
+    parts[i] = uploadStatePart{PartNumber: *p.PartNumber, ETag: *p.ETag}
+  }
+
+  return json.Marshal(parts)
+}
+
+func (u *uploadState) decodeParts(encoded []byte) (error) {
+  var parts []uploadStatePart
+  if err := json.Unmarshal(encoded, &parts); err != nil {
+    return err
+  }
+
+  u.parts = nil
+  for _, p := range parts {
+    number, etag := p.PartNumber, p.ETag
+    u.parts = append(u.parts, &s3.CompletedPart{PartNumber: &number, ETag: &etag})
+  }
+
+  return nil
+}
+
+type postgresUploadStates struct{}
+
+func (s *postgresUploadStates) load(accessKey, bucket, key string) (*uploadState, error) {
+  if db == nil {
+    return nil, nil
+  }
+
+  var query = `
+    SELECT upload_id, parts, size
+    FROM uploads
+    WHERE access_key_id = $1 AND bucket = $2 AND object_key = $3;
+  `
+
+  u := &uploadState{accessKey: accessKey, bucket: bucket, key: key}
+  var encodedParts []byte
+
+  err := db.QueryRow(query, accessKey, bucket, key).Scan(&u.uploadID, &encodedParts, &u.size)
+  if err == sql.ErrNoRows {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  if err := u.decodeParts(encodedParts); err != nil {
+    return nil, err
+  }
+
+  return u, nil
+}
+
+func (s *postgresUploadStates) save(u *uploadState) (error) {
+  if db == nil {
+    return nil
+  }
+
+  encodedParts, err := u.encodedParts()
+  if err != nil {
+    return err
+  }
+
+  var query = `
+    INSERT INTO uploads
+    (
+      access_key_id,
+      bucket,
+      object_key,
+      upload_id,
+      parts,
+      size
+    )
+    VALUES($1, $2, $3, $4, $5, $6)
+    ON CONFLICT (access_key_id, bucket, object_key) DO UPDATE
+    SET upload_id = EXCLUDED.upload_id,
+        parts = EXCLUDED.parts,
+        size = EXCLUDED.size,
+        updated_at = NOW();
+  `
+  _, err = db.Exec(query, u.accessKey, u.bucket, u.key, u.uploadID, encodedParts, u.size)
+
+  return err
+}
+
+func (s *postgresUploadStates) delete(u *uploadState) (error) {
+  if db == nil {
+    return nil
+  }
+
+  _, err := db.Exec(`DELETE FROM uploads WHERE upload_id = $1;`, u.uploadID)
+
+  return err
+}
+
+func (s *postgresUploadStates) list(accessKey string) ([]*uploadState, error) {
+  if db == nil {
+    return nil, nil
+  }
+
+  rows, err := db.Query(`SELECT bucket, object_key, upload_id FROM uploads WHERE access_key_id = $1;`, accessKey)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  var states []*uploadState
+
+  for rows.Next() {
+    u := &uploadState{accessKey: accessKey}
+    if err := rows.Scan(&u.bucket, &u.key, &u.uploadID); err != nil {
+      return states, err
+    }
+    states = append(states, u)
+  }
+
+  return states, rows.Err()
+}
+
+// One JSON file per user and path, named after a hash of the two
+type fileUploadStates struct {
+  dir string
+}
+
+type fileUploadState struct {
+  AccessKey string `json:"access_key_id"`
+  Bucket string `json:"bucket"`
+  Key string `json:"object_key"`
+  UploadID string `json:"upload_id"`
+  Parts json.RawMessage `json:"parts"`
+  Size int64 `json:"size"`
+}
+
+func newFileUploadStates(dir string) (*fileUploadStates, error) {
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return nil, err
+  }
+
+  return &fileUploadStates{dir: dir}, nil
+}
+
+func (s *fileUploadStates) path(accessKey, bucket, key string) (string) {
+  sum := sha256.Sum256([]byte(accessKey + delimiter + bucket + delimiter + key))
+
+  return filepath.Join(s.dir, hex.EncodeToString(sum[:]) + ".json")
+}
+
+func (s *fileUploadStates) load(accessKey, bucket, key string) (*uploadState, error) {
+  contents, err := ioutil.ReadFile(s.path(accessKey, bucket, key))
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  stored := &fileUploadState{}
+  if err := json.Unmarshal(contents, stored); err != nil {
+    return nil, err
+  }
+
+  u := &uploadState{
+    accessKey: stored.AccessKey,
+    bucket: stored.Bucket,
+    key: stored.Key,
+    uploadID: stored.UploadID,
+    size: stored.Size,
+  }
+
+  if err := u.decodeParts(stored.Parts); err != nil {
+    return nil, err
+  }
+
+  return u, nil
+}
+
+func (s *fileUploadStates) save(u *uploadState) (error) {
+  encodedParts, err := u.encodedParts()
+  if err != nil {
+    return err
+  }
+
+  contents, err := json.Marshal(&fileUploadState{
+    AccessKey: u.accessKey,
+    Bucket: u.bucket,
+    Key: u.key,
+    UploadID: u.uploadID,
+    Parts: encodedParts,
+    Size: u.size,
+  })
+  if err != nil {
+    return err
+  }
+
+  // write then rename so a crash never leaves half a file behind
+  path := s.path(u.accessKey, u.bucket, u.key)
+  if err := ioutil.WriteFile(path + ".tmp", contents, 0600); err != nil {
+    return err
+  }
+
+  return os.Rename(path + ".tmp", path)
+}
+
+// Only remove the file if it's still for the same upload
+func (s *fileUploadStates) delete(u *uploadState) (error) {
+  stored, err := s.load(u.accessKey, u.bucket, u.key)
+  if err != nil || stored == nil || stored.uploadID != u.uploadID {
+    return err
+  }
+
+  return os.Remove(s.path(u.accessKey, u.bucket, u.key))
+}
+
+func (s *fileUploadStates) list(accessKey string) ([]*uploadState, error) {
+  paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+  if err != nil {
+    return nil, err
+  }
+
+  var states []*uploadState
+
+  for _, path := range paths {
+    contents, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+      continue
+    }
+    if err != nil {
+      return states, err
+    }
+
+    stored := &fileUploadState{}
+    if err := json.Unmarshal(contents, stored); err != nil {
+      return states, err
+    }
+
+    if stored.AccessKey == accessKey {
+      states = append(states, &uploadState{accessKey: accessKey, bucket: stored.Bucket, key: stored.Key, uploadID: stored.UploadID})
+    }
+  }
+
+  return states, nil
+}
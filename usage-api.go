@@ -0,0 +1,296 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/csv"
+  "fmt"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+const (
+  usageDefaultLimit = 100
+  usageMaxLimit = 1000
+)
+
+// Filters shared by the usage endpoints
+type usageQuery struct {
+  accessKey string
+  from time.Time
+  to time.Time
+  granularity string
+  limit int
+  offset int
+  csv bool
+}
+
+// Reads access_key_id, from, to (RFC 3339 or YYYY-MM-DD), granularity
+// (day or month), limit, offset and format (json or csv). The range defaults
+// to the current month.
+func parseUsageQuery(r *http.Request) (*usageQuery, error) {
+  params := r.URL.Query()
+  now := time.Now().UTC()
+
+  q := &usageQuery{
+    accessKey: params.Get("access_key_id"),
+    from: time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC),
+    to: now,
+    granularity: "day",
+    limit: usageDefaultLimit,
+    csv: params.Get("format") == "csv",
+  }
+
+  var err error
+
+  if v := params.Get("from"); v != "" {
+    if q.from, err = parseUsageTime(v); err != nil {
+      return nil, fmt.Errorf("invalid from: %v", err)
+    }
+  }
+
+  if v := params.Get("to"); v != "" {
+    if q.to, err = parseUsageTime(v); err != nil {
+      return nil, fmt.Errorf("invalid to: %v", err)
+    }
+  }
+
+  if !q.from.Before(q.to) {
+    return nil, fmt.Errorf("from must be before to")
+  }
+
+  if v := params.Get("granularity"); v != "" {
+    if v != "day" && v != "month" {
+      return nil, fmt.Errorf("granularity must be day or month")
+    }
+    q.granularity = v
+  }
+
+  if v := params.Get("limit"); v != "" {
+    if q.limit, err = strconv.Atoi(v); err != nil || q.limit < 1 || q.limit > usageMaxLimit {
+      return nil, fmt.Errorf("limit must be between 1 and %d", usageMaxLimit)
+    }
+  }
+
+  if v := params.Get("offset"); v != "" {
+    if q.offset, err = strconv.Atoi(v); err != nil || q.offset < 0 {
+      return nil, fmt.Errorf("offset must be a positive number")
+    }
+  }
+
+  return q, nil
+}
+
+func parseUsageTime(v string) (time.Time, error) {
+  if t, err := time.Parse(time.RFC3339, v); err == nil {
+    return t, nil
+  }
+
+  return time.Parse("2006-01-02", v)
+}
+
+type usageRow struct {
+  AccessKey string `json:"access_key_id"`
+  Period time.Time `json:"period"`
+  Category string `json:"type"`
+  Count int64 `json:"count"`
+  Bytes int64 `json:"bytes"`
+}
+
+type usageSession struct {
+  SessionID string `json:"session_id"`
+  AccessKey string `json:"access_key_id"`
+  RemoteAddr string `json:"remote_addr,omitempty"`
+  StartedAt time.Time `json:"started_at"`
+  EndedAt time.Time `json:"ended_at"`
+  BytesRead int64 `json:"bytes_read"`
+  BytesWritten int64 `json:"bytes_written"`
+  Events int64 `json:"events"`
+}
+
+type usagePage struct {
+  Data interface{} `json:"data"`
+  Limit int `json:"limit"`
+  Offset int `json:"offset"`
+  NextOffset *int `json:"next_offset,omitempty"`
+}
+
+func newUsagePage(data interface{}, count int, q *usageQuery) (*usagePage) {
+  page := &usagePage{Data: data, Limit: q.limit, Offset: q.offset}
+
+  if count == q.limit {
+    next := q.offset + q.limit
+    page.NextOffset = &next
+  }
+
+  return page
+}
+
+// GET /usage, bytes and counts per access key, period and event type
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+  q, ok := usageRequest(w, r)
+  if !ok {
+    return
+  }
+
+  var query = `
+    SELECT
+      access_key_id,
+      date_trunc($2, created_at) AS period,
+      type,
+      COUNT(*),
+      COALESCE(SUM(size), 0)
+    FROM events
+    WHERE ($1 = '' OR access_key_id = $1)
+      AND created_at >= $3
+      AND created_at < $4
+    GROUP BY access_key_id, period, type
+    ORDER BY access_key_id, period, type
+    LIMIT $5 OFFSET $6;
+  `
+
+  rows, err := db.Query(query, q.accessKey, q.granularity, q.from, q.to, q.limit, q.offset)
+  if err != nil {
+    writeAPIError(w, http.StatusInternalServerError, err.Error())
+    return
+  }
+  defer rows.Close()
+
+  usage := []usageRow{}
+
+  for rows.Next() {
+    var u usageRow
+    if err := rows.Scan(&u.AccessKey, &u.Period, &u.Category, &u.Count, &u.Bytes); err != nil {
+      writeAPIError(w, http.StatusInternalServerError, err.Error())
+      return
+    }
+    usage = append(usage, u)
+  }
+
+  if err := rows.Err(); err != nil {
+    writeAPIError(w, http.StatusInternalServerError, err.Error())
+    return
+  }
+
+  if q.csv {
+    records := [][]string{{"access_key_id", "period", "type", "count", "bytes"}}
+    for _, u := range usage {
+      records = append(records, []string{
+        u.AccessKey,
+        u.Period.Format(time.RFC3339),
+        u.Category,
+        strconv.FormatInt(u.Count, 10),
+        strconv.FormatInt(u.Bytes, 10),
+      })
+    }
+    writeCSV(w, "usage.csv", records)
+    return
+  }
+
+  writeJSON(w, http.StatusOK, newUsagePage(usage, len(usage), q))
+}
+
+// GET /usage/sessions, one row per session with its transfer totals
+func usageSessionsHandler(w http.ResponseWriter, r *http.Request) {
+  q, ok := usageRequest(w, r)
+  if !ok {
+    return
+  }
+
+  var query = `
+    SELECT
+      session_id,
+      access_key_id,
+      MAX(remote_addr),
+      MIN(COALESCE(started_at, created_at)) AS session_started_at,
+      MAX(COALESCE(ended_at, created_at)),
+      COALESCE(SUM(CASE WHEN type = 'READ' THEN size ELSE 0 END), 0),
+      COALESCE(SUM(CASE WHEN type = 'WRITE' THEN size ELSE 0 END), 0),
+      COUNT(*)
+    FROM events
+    WHERE ($1 = '' OR access_key_id = $1)
+      AND created_at >= $2
+      AND created_at < $3
+    GROUP BY session_id, access_key_id
+    ORDER BY session_started_at DESC
+    LIMIT $4 OFFSET $5;
+  `
+
+  rows, err := db.Query(query, q.accessKey, q.from, q.to, q.limit, q.offset)
+  if err != nil {
+    writeAPIError(w, http.StatusInternalServerError, err.Error())
+    return
+  }
+  defer rows.Close()
+
+  sessions := []usageSession{}
+
+  for rows.Next() {
+    var s usageSession
+    var remoteAddr sql.NullString
+
+    err := rows.Scan(&s.SessionID, &s.AccessKey, &remoteAddr, &s.StartedAt, &s.EndedAt, &s.BytesRead, &s.BytesWritten, &s.Events)
+    if err != nil {
+      writeAPIError(w, http.StatusInternalServerError, err.Error())
+      return
+    }
+
+    s.RemoteAddr = remoteAddr.String
+    sessions = append(sessions, s)
+  }
+
+  if err := rows.Err(); err != nil {
+    writeAPIError(w, http.StatusInternalServerError, err.Error())
+    return
+  }
+
+  if q.csv {
+    records := [][]string{{"session_id", "access_key_id", "remote_addr", "started_at", "ended_at", "bytes_read", "bytes_written", "events"}}
+    for _, s := range sessions {
+      records = append(records, []string{
+        s.SessionID,
+        s.AccessKey,
+        s.RemoteAddr,
+        s.StartedAt.Format(time.RFC3339),
+        s.EndedAt.Format(time.RFC3339),
+        strconv.FormatInt(s.BytesRead, 10),
+        strconv.FormatInt(s.BytesWritten, 10),
+        strconv.FormatInt(s.Events, 10),
+      })
+    }
+    writeCSV(w, "sessions.csv", records)
+    return
+  }
+
+  writeJSON(w, http.StatusOK, newUsagePage(sessions, len(sessions), q))
+}
+
+// Checks the method and database and parses the filters, writing the error
+// response itself when the request can't be served.
+func usageRequest(w http.ResponseWriter, r *http.Request) (*usageQuery, bool) {
+  if r.Method != "GET" {
+    writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return nil, false
+  }
+
+  q, err := parseUsageQuery(r)
+  if err != nil {
+    writeAPIError(w, http.StatusBadRequest, err.Error())
+    return nil, false
+  }
+
+  if db == nil {
+    writeAPIError(w, http.StatusServiceUnavailable, "usage reporting needs a database")
+    return nil, false
+  }
+
+  return q, true
+}
+
+func writeCSV(w http.ResponseWriter, filename string, records [][]string) {
+  w.Header().Set("Content-Type", "text/csv")
+  w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+  writer := csv.NewWriter(w)
+  writer.WriteAll(records)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "testing"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func TestUsageAPIRequiresToken(t *testing.T) {
+  adminAPIToken = "secret"
+  defer func() { adminAPIToken = "" }()
+
+  mux := http.NewServeMux()
+  registerAdminAPI(mux)
+
+  req := httptest.NewRequest("GET", "/usage", nil)
+  res := httptest.NewRecorder()
+  mux.ServeHTTP(res, req)
+  assert.Equal(t, http.StatusUnauthorized, res.Code)
+
+  req = httptest.NewRequest("GET", "/usage", nil)
+  req.Header.Set("Authorization", "Bearer secret")
+  res = httptest.NewRecorder()
+  mux.ServeHTTP(res, req)
+  assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+}
+
+func TestUsageAPIDisabledWithoutToken(t *testing.T) {
+  mux := http.NewServeMux()
+  registerAdminAPI(mux)
+
+  req := httptest.NewRequest("GET", "/usage/sessions", nil)
+  res := httptest.NewRecorder()
+  mux.ServeHTTP(res, req)
+  assert.Equal(t, http.StatusNotFound, res.Code)
+}
+
+func TestParseUsageQuery(t *testing.T) {
+  req := httptest.NewRequest("GET", "/usage?from=2018-03-01&to=2018-04-01T00:00:00Z&granularity=month&limit=10&offset=20&format=csv", nil)
+  q, err := parseUsageQuery(req)
+  assert.Nil(t, err)
+  assert.Equal(t, "month", q.granularity)
+  assert.Equal(t, 10, q.limit)
+  assert.Equal(t, 20, q.offset)
+  assert.True(t, q.csv)
+
+  for _, bad := range []string{"granularity=week", "limit=0", "offset=-1", "from=2018-04-01&to=2018-03-01", "from=yesterday"} {
+    _, err := parseUsageQuery(httptest.NewRequest("GET", "/usage?" + bad, nil))
+    assert.NotNil(t, err, bad)
+  }
+}
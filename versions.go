@@ -0,0 +1,239 @@
+package main
+
+import (
+  "context"
+  "os"
+  "strings"
+  "time"
+
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/service/s3"
+)
+
+// With VERSIONS_DIRECTORY set every directory in a versioned bucket gets a
+// virtual .versions directory. .versions/<name>/ lists every version of
+// <name>, named by when it was written, which can be downloaded or renamed
+// back over <name> to restore it.
+var versionsDirectory int
+
+func init() {
+  setFromENV("VERSIONS_DIRECTORY", &versionsDirectory, 0)
+}
+
+const (
+  versionsDirName = ".versions"
+  // sorts oldest first and has no -, so the version ID follows the first one
+  versionTimeFormat = "20060102T150405Z"
+)
+
+// Somewhere under a .versions directory
+type versionPath struct {
+  bucket string
+  dir string // key prefix of the directory the .versions directory is in
+  name string // empty for .versions itself
+  version string // the version's file name, empty for a directory
+}
+
+func (v *versionPath) key() (string) {
+  return v.dir + v.name
+}
+
+// nil when p isn't under a .versions directory or they're turned off. Any
+// .versions segment counts, so with them on real keys with a .versions/ in
+// them can't be reached.
+func parseVersionPath(p string) (*versionPath) {
+  if versionsDirectory == 0 || p == "/" {
+    return nil
+  }
+
+  bucket, key := bucket_parts_from_filepath(p)
+  segments := strings.Split(strings.TrimSuffix(key, delimiter), delimiter)
+
+  for i, segment := range segments {
+    if segment != versionsDirName {
+      continue
+    }
+
+    rest := segments[i + 1:]
+    if len(rest) > 2 {
+      return nil
+    }
+
+    v := &versionPath{bucket: bucket}
+    if i > 0 {
+      v.dir = strings.Join(segments[:i], delimiter) + delimiter
+    }
+    if len(rest) > 0 {
+      v.name = rest[0]
+    }
+    if len(rest) > 1 {
+      v.version = rest[1]
+    }
+
+    return v
+  }
+
+  return nil
+}
+
+func versionName(lastModified time.Time, versionID string) (string) {
+  return lastModified.UTC().Format(versionTimeFormat) + "-" + versionID
+}
+
+func versionIDFromName(name string) (string, bool) {
+  i := strings.Index(name, "-")
+  if i < 0 || i == len(name) - 1 {
+    return "", false
+  }
+
+  return name[i + 1:], true
+}
+
+// nil for the current version
+func (f *s3File) version() (*string) {
+  if f.versionID == "" {
+    return nil
+  }
+
+  return aws.String(f.versionID)
+}
+
+func (fs *s3fs) version_file(ctx context.Context, v *versionPath, p string) (*s3File, error) {
+  if v.name == "" {
+    return &s3File{name: p, isdir: true}, nil
+  }
+
+  if v.version == "" {
+    if len(fs.version_listing(ctx, v)) == 0 {
+      return nil, os.ErrNotExist
+    }
+    return &s3File{name: p, isdir: true}, nil
+  }
+
+  versionID, ok := versionIDFromName(v.version)
+  if !ok {
+    return nil, os.ErrNotExist
+  }
+
+  input := &s3.HeadObjectInput{
+    Bucket: aws.String(v.bucket),
+    Key: aws.String(v.key()),
+    VersionId: aws.String(versionID),
+  }
+  fs.encryption_for(v.bucket).applyToHead(input)
+
+  output, err := fs.HeadObjectWithContext(ctx, input)
+  if err != nil {
+    return nil, err
+  }
+
+  file := &s3File{
+    name: p,
+    key: v.key(),
+    versionID: versionID,
+    size: aws.Int64Value(output.ContentLength),
+    bucket: v.bucket,
+    archived: isArchived(output.StorageClass, output.Restore),
+    s3fs: fs,
+  }
+
+  if isEnvelope(output.Metadata) {
+    file.size = plaintextSize(file.size)
+  }
+
+  return file, nil
+}
+
+// In .versions the objects that have versions here, deleted ones included,
+// and in .versions/<name> the versions of <name>. Not cached, every upload
+// makes a new version.
+func (fs *s3fs) version_listing(ctx context.Context, v *versionPath) (map[string]*s3File) {
+  files := make(map[string]*s3File)
+
+  input := &s3.ListObjectVersionsInput{
+    Bucket: aws.String(v.bucket),
+    Prefix: aws.String(v.key()),
+    MaxKeys: aws.Int64(1000),
+  }
+  if v.name == "" {
+    input.Delimiter = aws.String(delimiter)
+  }
+
+  err := fs.ListObjectVersionsPagesWithContext(ctx, input, func(page *s3.ListObjectVersionsOutput, last bool) (bool) {
+    if v.name == "" {
+      for _, version := range page.Versions {
+        fs.add_versioned_object(files, v, aws.StringValue(version.Key))
+      }
+      for _, marker := range page.DeleteMarkers {
+        fs.add_versioned_object(files, v, aws.StringValue(marker.Key))
+      }
+      return true
+    }
+
+    for _, version := range page.Versions {
+      key := aws.StringValue(version.Key)
+
+      // the prefix also matches longer names, they come after ours
+      if key > v.key() {
+        return false
+      }
+      if key != v.key() {
+        continue
+      }
+
+      name := versionName(aws.TimeValue(version.LastModified), aws.StringValue(version.VersionId))
+      files[name] = &s3File{
+        name: name,
+        bucket: v.bucket,
+        key: key,
+        versionID: aws.StringValue(version.VersionId),
+        size: aws.Int64Value(version.Size),
+        archived: isArchived(version.StorageClass, nil),
+      }
+    }
+
+    return true
+  })
+
+  if err != nil {
+    fs.log.Warn("could not list object versions", "bucket", v.bucket, "prefix", v.key(), "error", err)
+  } else if fs.encryption_for(v.bucket).client_side() {
+    fs.envelope_sizes(ctx, files)
+  }
+
+  return files
+}
+
+// Whether bucket has ever had versioning turned on, suspended buckets still
+// keep their old versions. Asked once a session, a bucket we can't ask about
+// gets no .versions directory.
+func (fs *s3fs) bucket_versioned(ctx context.Context, bucket string) (bool) {
+  fs.versioningLock.Lock()
+  defer fs.versioningLock.Unlock()
+
+  if versioned, ok := fs.versioning[bucket]; ok {
+    return versioned
+  }
+
+  output, err := fs.GetBucketVersioningWithContext(ctx, &s3.GetBucketVersioningInput{Bucket: aws.String(bucket)})
+  if err != nil {
+    fs.log.Debug("could not get bucket versioning", "bucket", bucket, "error", err)
+    return false
+  }
+
+  if fs.versioning == nil {
+    fs.versioning = make(map[string]bool)
+  }
+  fs.versioning[bucket] = aws.StringValue(output.Status) != ""
+
+  return fs.versioning[bucket]
+}
+
+func (fs *s3fs) add_versioned_object(files map[string]*s3File, v *versionPath, key string) {
+  name := strings.TrimPrefix(key, v.dir)
+  if name == "" || strings.Contains(name, delimiter) {
+    return
+  }
+
+  files[key] = &s3File{name: name, bucket: v.bucket, isdir: true}
+}